@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing/topics"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// loadGame restores the save at path, then lets the server correct it, so
+// an old save can't bring back units that were lost since.
+func loadGame(
+	gs *gamelogic.GameState,
+	conn *amqp.Connection,
+	outbox *pubsub.Outbox,
+	moves *pubsub.HeaderSubscription,
+	path string,
+) error {
+	save, err := gamelogic.ReadSave(path)
+	if err != nil {
+		return err
+	}
+	err = gs.Restore(save)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Loaded %d event(s) saved at %s\n", len(save.Events), save.SavedAt.Format(time.RFC3339))
+
+	reconcile(gs, conn, outbox)
+	updateMoveFilter(gs, moves)
+	return nil
+}
+
+// reconcile replaces the player's units with the server's view of them, and
+// its rules with the server's if they differ. When no server answers the
+// local units are kept, and the server still checks every move made with
+// them.
+func reconcile(gs *gamelogic.GameState, conn *amqp.Connection, outbox *pubsub.Outbox) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Spawns and moves still in the outbox would be undone otherwise. The
+	// server reads them from other queues, so a sync right after a flush can
+	// still miss one; the next move verdict corrects that.
+	err := outbox.Flush(ctx)
+	if err != nil {
+		log.Println("Could not reconcile with the server:", err)
+		return
+	}
+
+	_, hash := gamelogic.ActiveRuleset()
+	reply, err := pubsub.Request[gamelogic.SyncRequest, gamelogic.SyncReply](
+		ctx,
+		conn,
+		topics.Syncs,
+		gamelogic.SyncRequest{Username: gs.GetUsername(), RulesHash: hash},
+		5*time.Second,
+	)
+	if errors.Is(err, pubsub.ErrNoReply) {
+		log.Println("No server answered, your units will be checked as you move them")
+		return
+	}
+	if err != nil {
+		log.Println("Could not reconcile with the server:", err)
+		return
+	}
+
+	if reply.Rules != nil {
+		useRuleset(*reply.Rules)
+	}
+
+	if gs.Reconcile(reply) {
+		fmt.Printf("The server corrected your units, you now have %d\n", len(gs.GetPlayerSnap().Units))
+	}
+}
+
+// autosave saves the game every interval until ctx is done.
+func autosave(ctx context.Context, gs *gamelogic.GameState, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := gs.Save(path)
+			if err != nil {
+				fmt.Println()
+				log.Println("Error saving game:", err)
+				fmt.Print("> ")
+			}
+		}
+	}
+}
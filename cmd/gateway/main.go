@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/config"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing/topics"
+	"github.com/gorilla/websocket"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	listenAddr = ":8080"
+
+	loginTimeout = 10 * time.Second
+)
+
+type gateway struct {
+	// tokensFile is re-read on every login, so players can be added without
+	// restarting the gateway.
+	tokensFile string
+	upgrader   websocket.Upgrader
+	amqpURL    string
+	dial       pubsub.DialOptions
+	tenant     pubsub.Tenant
+
+	mu      sync.Mutex
+	players map[string]struct{}
+}
+
+func main() {
+	cfg, err := config.Load("peril-gateway", os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tenant := cfg.ParsedTenant()
+	topics.UseExchanges(cfg.Exchanges.Direct, cfg.Exchanges.Topic)
+	topics.UseTenant(tenant)
+
+	if cfg.Gateway.TokensFile == "" {
+		log.Fatal("peril-gateway needs gateway.tokens_file to know who may play")
+	}
+	if _, err := loadTokens(cfg.Gateway.TokensFile); err != nil {
+		log.Fatal(err)
+	}
+
+	conn, err := tenant.Dial(cfg.AMQPURL, cfg.DialOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = followRuleset(conn, tenant)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	gw := &gateway{
+		tokensFile: cfg.Gateway.TokensFile,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     checkOrigin(cfg.Gateway.AllowedOrigins),
+		},
+		amqpURL: cfg.AMQPURL,
+		dial:    cfg.DialOptions(),
+		tenant:  tenant,
+		players: map[string]struct{}{},
+	}
+
+	http.HandleFunc("/ws", gw.handleWebSocket)
+
+	log.Printf("Peril gateway for tenant %s listening on %s\n", tenant, listenAddr)
+	log.Fatal(http.ListenAndServe(listenAddr, nil))
+}
+
+// followRuleset plays by the server's rules. They apply to every session, so
+// the gateway follows them once rather than each session.
+func followRuleset(conn *amqp.Connection, tenant pubsub.Tenant) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	err = topics.DeclareExchanges(ch)
+	if err != nil {
+		return err
+	}
+
+	// Several gateways may run at once, each with a queue of its own.
+	id := strconv.Itoa(os.Getpid())
+	_, err = pubsub.SubscribeRetained(
+		context.Background(),
+		conn,
+		topics.Ruleset,
+		tenant.Queue(routing.RulesetGatewayQueue(id)),
+		pubsub.Transient,
+		handleRuleset,
+		pubsub.SubscribeOptions{},
+	)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to ruleset: %v", err)
+	}
+	return nil
+}
+
+func handleRuleset(_ context.Context, msg pubsub.Message[gamelogic.Ruleset]) (pubsub.Acktype, error) {
+	changed, err := gamelogic.UseRuleset(msg.Body)
+	if err != nil {
+		return pubsub.NackDiscard, fmt.Errorf("invalid ruleset: %v", err)
+	}
+	if changed {
+		_, hash := gamelogic.ActiveRuleset()
+		log.Printf("Playing by ruleset %s (%.12s)\n", msg.Body.Name, hash)
+	}
+	return pubsub.Ack, nil
+}
+
+func (gw *gateway) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := gw.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Error upgrading connection:", err)
+		return
+	}
+	defer ws.Close()
+
+	username, err := gw.login(ws)
+	if err != nil {
+		log.Println("Login failed:", err)
+		ws.WriteJSON(outFrame{Type: "error", Data: err.Error()})
+		return
+	}
+	defer gw.logout(username)
+
+	s, err := newSession(ws, username, gw.amqpURL, gw.dial, gw.tenant)
+	if err != nil {
+		log.Printf("Could not start session for %s: %v\n", username, err)
+		ws.WriteJSON(outFrame{Type: "error", Data: "could not join the game"})
+		return
+	}
+	defer s.close()
+
+	log.Printf("%s joined through the gateway\n", username)
+	s.run()
+	log.Printf("%s left the gateway\n", username)
+}
+
+func (gw *gateway) login(ws *websocket.Conn) (string, error) {
+	ws.SetReadDeadline(time.Now().Add(loginTimeout))
+	defer ws.SetReadDeadline(time.Time{})
+
+	var frame inFrame
+	if err := ws.ReadJSON(&frame); err != nil {
+		return "", err
+	}
+	if frame.Type != "login" {
+		return "", errors.New("the first frame must be a login")
+	}
+	if err := routing.ValidateUsername(frame.Username); err != nil {
+		return "", err
+	}
+
+	toks, err := loadTokens(gw.tokensFile)
+	if err != nil {
+		log.Println("Error loading tokens:", err)
+		return "", errors.New("could not check the token")
+	}
+	if !toks.check(frame.Username, frame.Token) {
+		return "", errors.New("invalid username or token")
+	}
+
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if _, ok := gw.players[frame.Username]; ok {
+		return "", errors.New("username already connected")
+	}
+	gw.players[frame.Username] = struct{}{}
+
+	return frame.Username, nil
+}
+
+func (gw *gateway) logout(username string) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	delete(gw.players, username)
+}
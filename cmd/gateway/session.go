@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing/topics"
+	"github.com/gorilla/websocket"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// sendBuffer frames may be queued for a browser before pushes block.
+	sendBuffer = 32
+	// A push that stays blocked for sendTimeout means the browser can't keep
+	// up: the message is requeued on the broker and the connection dropped.
+	sendTimeout = 5 * time.Second
+
+	pingInterval = 30 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+// inFrame is a command sent by the browser.
+type inFrame struct {
+	Type     string `json:"type"`
+	Username string `json:"username,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Location string `json:"location,omitempty"`
+	Rank     string `json:"rank,omitempty"`
+	Units    []int  `json:"units,omitempty"`
+}
+
+// outFrame is an event pushed to the browser.
+type outFrame struct {
+	Type string `json:"type"`
+	Data any    `json:"data,omitempty"`
+}
+
+// battleFrame is the server's outcome of a battle, and whether the player
+// "won", "lost" or fought to a "draw".
+type battleFrame struct {
+	Outcome string `json:"outcome"`
+	gamelogic.BattleResult
+}
+
+type rulesFrame struct {
+	gamelogic.Ruleset
+	Hash string `json:"hash"`
+}
+
+type statusFrame struct {
+	Paused bool             `json:"paused"`
+	Player gamelogic.Player `json:"player"`
+}
+
+// session is one browser player. Each session has its own broker connection,
+// so closing it tears down the player's queues and consumers.
+type session struct {
+	ws       *websocket.Conn
+	username string
+	tenant   pubsub.Tenant
+	state    *gamelogic.GameState
+
+	conn *amqp.Connection
+	ch   *amqp.Channel
+
+	send      chan outFrame
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSession(ws *websocket.Conn, username, amqpURL string, dial pubsub.DialOptions, tenant pubsub.Tenant) (*session, error) {
+	conn, err := tenant.Dial(amqpURL, dial)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	err = topics.DeclareExchanges(ch)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s := &session{
+		ws:       ws,
+		username: username,
+		tenant:   tenant,
+		state:    gamelogic.NewGameState(username),
+		conn:     conn,
+		ch:       ch,
+		send:     make(chan outFrame, sendBuffer),
+		done:     make(chan struct{}),
+	}
+
+	if err := s.subscribe(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.sync()
+
+	return s, nil
+}
+
+// syncWait is how long a login waits for the server to say what units the
+// player has.
+const syncWait = 5 * time.Second
+
+// sync gives a player who logs in the units the server's ledger has for
+// them. When no server answers the player starts with none, and the server
+// still checks every move they make.
+func (s *session) sync() {
+	_, hash := gamelogic.ActiveRuleset()
+	reply, err := pubsub.Request[gamelogic.SyncRequest, gamelogic.SyncReply](
+		context.Background(),
+		s.conn,
+		topics.Syncs,
+		gamelogic.SyncRequest{Username: s.username, RulesHash: hash},
+		syncWait,
+	)
+	if err != nil {
+		log.Printf("Could not sync %s with the server: %v\n", s.username, err)
+		return
+	}
+	s.state.Reconcile(reply)
+}
+
+func (s *session) subscribe() error {
+	_, err := pubsub.SubscribeRetained(
+		context.Background(),
+		s.conn,
+		topics.Pause,
+		s.tenant.Queue(routing.PauseQueue(s.username)),
+		pubsub.Transient,
+		s.handlePause,
+		pubsub.SubscribeOptions{},
+	)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to pause: %v", err)
+	}
+
+	_, err = pubsub.SubscribeRetained(
+		context.Background(),
+		s.conn,
+		topics.Ruleset,
+		s.tenant.Queue(routing.RulesetQueue(s.username)),
+		pubsub.Transient,
+		s.handleRuleset,
+		pubsub.SubscribeOptions{},
+	)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to ruleset: %v", err)
+	}
+
+	err = pubsub.Subscribe(
+		s.conn,
+		topics.ArmyMoves,
+		s.tenant.Queue(routing.ArmyMovesQueue(s.username)),
+		pubsub.Transient,
+		s.handleMove,
+	)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to army moves: %v", err)
+	}
+
+	err = pubsub.Subscribe(
+		s.conn,
+		topics.MoveVerdictsFor(s.username),
+		s.tenant.Queue(routing.MoveVerdictQueue(s.username)),
+		pubsub.Transient,
+		s.handleMoveVerdict,
+	)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to move verdicts: %v", err)
+	}
+
+	err = pubsub.Subscribe(
+		s.conn,
+		topics.Battles,
+		s.tenant.Queue(routing.BattleQueue(s.username)),
+		pubsub.Transient,
+		s.handleBattle,
+	)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to battles: %v", err)
+	}
+
+	err = pubsub.Subscribe(
+		s.conn,
+		topics.GameLogs,
+		s.tenant.Queue(routing.GameLogGatewayQueue(s.username)),
+		pubsub.Transient,
+		s.handleGameLog,
+	)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to game logs: %v", err)
+	}
+
+	return nil
+}
+
+func (s *session) run() {
+	go s.writeLoop()
+	go s.arriveLoop()
+
+	s.push(outFrame{Type: "welcome", Data: s.username})
+	s.pushStatus()
+
+	for {
+		var frame inFrame
+		if err := s.ws.ReadJSON(&frame); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("Error reading from %s: %v\n", s.username, err)
+			}
+			return
+		}
+
+		if err := s.handleCommand(frame); err != nil {
+			if !s.push(outFrame{Type: "error", Data: err.Error()}) {
+				return
+			}
+		}
+	}
+}
+
+func (s *session) handleCommand(frame inFrame) error {
+	switch frame.Type {
+	case "spawn":
+		spawn, err := s.state.CommandSpawn([]string{"spawn", frame.Location, frame.Rank})
+		if err != nil {
+			return err
+		}
+		err = pubsub.Publish(s.ch, topics.Spawns, spawn)
+		if err != nil {
+			log.Println("Error publishing JSON:", err)
+			return errors.New("could not publish spawn")
+		}
+		s.pushStatus()
+
+	case "move":
+		words := []string{"move", frame.Location}
+		for _, id := range frame.Units {
+			words = append(words, strconv.Itoa(id))
+		}
+		move, err := s.state.CommandMove(words)
+		if err != nil {
+			return err
+		}
+		err = pubsub.Publish(s.ch, topics.ArmyMoves, move)
+		if err != nil {
+			log.Println("Error publishing JSON:", err)
+			return errors.New("could not publish move")
+		}
+		s.pushStatus()
+
+	case "status":
+		s.pushStatus()
+
+	default:
+		return fmt.Errorf("unknown command: %s", frame.Type)
+	}
+
+	return nil
+}
+
+func (s *session) pushStatus() {
+	s.push(outFrame{Type: "status", Data: statusFrame{
+		Paused: s.state.IsPaused(),
+		Player: s.state.GetPlayerSnap(),
+	}})
+}
+
+// push queues a frame for the browser. It reports false when the session is
+// closed or the browser is too slow, in which case the session is closed.
+func (s *session) push(frame outFrame) bool {
+	select {
+	case s.send <- frame:
+		return true
+	case <-s.done:
+		return false
+	default:
+	}
+
+	timer := time.NewTimer(sendTimeout)
+	defer timer.Stop()
+	select {
+	case s.send <- frame:
+		return true
+	case <-s.done:
+		return false
+	case <-timer.C:
+		log.Printf("%s is not reading fast enough, closing connection\n", s.username)
+		s.close()
+		return false
+	}
+}
+
+func (s *session) writeLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case frame := <-s.send:
+			s.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := s.ws.WriteJSON(frame); err != nil {
+				s.close()
+				return
+			}
+		case <-ticker.C:
+			err := s.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+			if err != nil {
+				s.close()
+				return
+			}
+		}
+	}
+}
+
+// arriveLoop lands the player's travelling units as they arrive, every tick
+// until the session closes.
+func (s *session) arriveLoop() {
+	ticker := time.NewTicker(gamelogic.TickDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		arrived := s.state.Arrive(gamelogic.CurrentTick())
+		for _, mv := range arrived {
+			err := pubsub.Publish(s.ch, topics.ArmyMoves, mv)
+			if err != nil {
+				log.Println("Error publishing JSON:", err)
+				s.push(outFrame{Type: "error", Data: "could not publish arrival"})
+			}
+		}
+		if len(arrived) > 0 {
+			s.pushStatus()
+		}
+	}
+}
+
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.ws.Close()
+		s.conn.Close()
+	})
+}
+
+func (s *session) handlePause(_ context.Context, msg pubsub.Message[routing.PlayingState]) (pubsub.Acktype, error) {
+	s.state.HandlePause(msg.Body)
+	if !s.push(outFrame{Type: "pause", Data: msg.Body}) {
+		return pubsub.NackRequeue, nil
+	}
+
+	err := pubsub.Reply(s.ch, msg, s.username)
+	if err != nil {
+		return pubsub.Ack, fmt.Errorf("could not acknowledge pause state: %v", err)
+	}
+	return pubsub.Ack, nil
+}
+
+// handleRuleset shows the browser the server's rules. The gateway plays by
+// them: see handleRuleset in main.go.
+func (s *session) handleRuleset(_ context.Context, msg pubsub.Message[gamelogic.Ruleset]) (pubsub.Acktype, error) {
+	if err := msg.Body.Validate(); err != nil {
+		return pubsub.NackDiscard, fmt.Errorf("invalid ruleset: %v", err)
+	}
+
+	if !s.push(outFrame{Type: "rules", Data: rulesFrame{Ruleset: msg.Body, Hash: msg.Body.Hash()}}) {
+		return pubsub.NackRequeue, nil
+	}
+	return pubsub.Ack, nil
+}
+
+func (s *session) handleMove(mv gamelogic.ArmyMove) pubsub.Acktype {
+	switch s.state.HandleMove(mv) {
+	case gamelogic.MoveOutComeSafe, gamelogic.MoveOutcomeMakeWar:
+		if !s.push(outFrame{Type: "move", Data: mv}) {
+			return pubsub.NackRequeue
+		}
+		return pubsub.Ack
+	default:
+		return pubsub.NackDiscard
+	}
+}
+
+func (s *session) handleMoveVerdict(v gamelogic.MoveVerdict) pubsub.Acktype {
+	if v.Accepted {
+		return pubsub.Ack
+	}
+
+	s.state.HandleMoveVerdict(v)
+	if !s.push(outFrame{Type: "error", Data: "move rejected: " + v.Reason}) {
+		return pubsub.NackRequeue
+	}
+	s.pushStatus()
+	return pubsub.Ack
+}
+
+func (s *session) handleBattle(b gamelogic.BattleResult) pubsub.Acktype {
+	if !s.state.HandleBattle(b) {
+		return pubsub.Ack
+	}
+
+	frame := battleFrame{Outcome: "lost", BattleResult: b}
+	switch {
+	case b.Draw:
+		frame.Outcome = "draw"
+	case slices.Contains(b.Winners, s.username):
+		frame.Outcome = "won"
+	}
+	s.push(outFrame{Type: "battle", Data: frame})
+	s.pushStatus()
+	return pubsub.Ack
+}
+
+func (s *session) handleGameLog(gl routing.GameLog) pubsub.Acktype {
+	if !s.push(outFrame{Type: "log", Data: gl}) {
+		return pubsub.NackRequeue
+	}
+	return pubsub.Ack
+}
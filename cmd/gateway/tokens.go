@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// tokens maps each player allowed through the gateway to their login token.
+type tokens map[string]string
+
+// loadTokens reads a tokens file: one "username token" pair per line, with
+// blank lines and lines starting with # skipped.
+func loadTokens(path string) (tokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open tokens file: %v", err)
+	}
+	defer f.Close()
+
+	toks := tokens{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want a username and a token", path, n)
+		}
+		if err := routing.ValidateUsername(fields[0]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if _, ok := toks[fields[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is listed twice", path, n, fields[0])
+		}
+		toks[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read tokens file: %v", err)
+	}
+	return toks, nil
+}
+
+// check reports whether token is username's.
+func (t tokens) check(username, token string) bool {
+	want, ok := t[username]
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// checkOrigin lets browsers open the WebSocket only from an allowed origin,
+// or from the gateway's own when none are configured. Requests without an
+// Origin don't come from a browser page.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+
+		if len(allowed) == 0 {
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		}
+		for _, o := range allowed {
+			if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    tokens
+		wantErr bool
+	}{
+		{
+			name: "pairs, comments and blank lines",
+			file: "# players\nalice s3cret\n\n  bob.*# hunter2  \n",
+			want: tokens{"alice": "s3cret", "bob.*#": "hunter2"},
+		},
+		{name: "missing token", file: "alice\n", wantErr: true},
+		{name: "extra field", file: "alice s3cret extra\n", wantErr: true},
+		{name: "listed twice", file: "alice a\nalice b\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tokens.txt")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadTokens(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for username, token := range tt.want {
+				if got[username] != token {
+					t.Errorf("token of %s is %q, want %q", username, got[username], token)
+				}
+			}
+		})
+	}
+}
+
+func TestTokensCheck(t *testing.T) {
+	toks := tokens{"alice": "s3cret", "bob": "hunter2"}
+	tests := []struct {
+		username string
+		token    string
+		want     bool
+	}{
+		{"alice", "s3cret", true},
+		{"bob", "hunter2", true},
+		{"alice", "hunter2", false},
+		{"alice", "", false},
+		{"mallory", "s3cret", false},
+		{"mallory", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := toks.check(tt.username, tt.token); got != tt.want {
+			t.Errorf("check(%q, %q) = %v, want %v", tt.username, tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	allowed := []string{"https://peril.example.com", "http://localhost:3000/"}
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{"no origin", allowed, "", true},
+		{"allowed", allowed, "https://peril.example.com", true},
+		{"allowed with trailing slash", allowed, "http://localhost:3000", true},
+		{"allowed case insensitive", allowed, "https://Peril.Example.com", true},
+		{"other origin", allowed, "https://evil.example.com", false},
+		{"other scheme", allowed, "http://peril.example.com", false},
+		{"same origin without list", nil, "http://gateway.example.com:8080", true},
+		{"cross origin without list", nil, "https://evil.example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://gateway.example.com:8080/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := checkOrigin(tt.allowed)(r); got != tt.want {
+				t.Errorf("checkOrigin(%v) for %q = %v, want %v", tt.allowed, tt.origin, got, tt.want)
+			}
+		})
+	}
+}
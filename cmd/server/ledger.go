@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing/topics"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// subscribeLedger feeds the ledger with every spawn and move, answers each
+// with a verdict, fights a battle wherever units spawn or arrive among
+// enemies and tells restored clients what units they have.
+func subscribeLedger(
+	ctx context.Context,
+	conn *amqp.Connection,
+	ch *amqp.Channel,
+	tenant pubsub.Tenant,
+	ledger *gamelogic.Ledger,
+	opts pubsub.SubscribeOptions,
+) error {
+	v := &victory{ledger: ledger, ch: ch}
+
+	_, err := pubsub.SubscribeContext(
+		ctx,
+		conn,
+		topics.Spawns,
+		tenant.Queue(routing.LedgerQueue(routing.SpawnsPrefix)),
+		pubsub.Durable,
+		handleSpawn(ledger, ch, v),
+		opts,
+	)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to spawns: %v", err)
+	}
+
+	_, err = pubsub.SubscribeContext(
+		ctx,
+		conn,
+		topics.ArmyMoves,
+		tenant.Queue(routing.LedgerQueue(routing.ArmyMovesPrefix)),
+		pubsub.Durable,
+		handleLedgerMove(ledger, ch, v),
+		opts,
+	)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to army moves: %v", err)
+	}
+
+	// Transient: a sync nobody answered in time is no longer waited for.
+	_, err = pubsub.SubscribeContext(
+		ctx,
+		conn,
+		topics.Syncs,
+		tenant.Queue(routing.LedgerQueue(routing.SyncsPrefix)),
+		pubsub.Transient,
+		handleSync(ledger, ch),
+		opts,
+	)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to syncs: %v", err)
+	}
+
+	return nil
+}
+
+func handleSpawn(ledger *gamelogic.Ledger, ch *amqp.Channel, v *victory) pubsub.Handler[gamelogic.ArmySpawn] {
+	return func(_ context.Context, msg pubsub.Message[gamelogic.ArmySpawn]) (pubsub.Acktype, error) {
+		sp := msg.Body
+		// The routing key, which broker topic permissions can restrict to the
+		// player's own, and not the body says whose unit this is.
+		owner, err := routing.ParseSpawnKey(msg.RoutingKey)
+		if err != nil || owner != sp.Username {
+			return pubsub.NackDiscard, fmt.Errorf("spawn by %s was published as %q", sp.Username, msg.RoutingKey)
+		}
+
+		verdict := gamelogic.MoveVerdict{Spawn: &sp, Accepted: true}
+		err = ledger.Spawn(sp)
+		if errors.Is(err, gamelogic.ErrLedgerNotSaved) {
+			return pubsub.NackRequeue, err
+		}
+		if err != nil {
+			log.Printf("Rejected spawn by %s: %v\n", sp.Username, err)
+			verdict.Accepted = false
+			verdict.Reason = err.Error()
+		}
+		verdict.Player = ledger.Player(sp.Username)
+
+		err = pubsub.Publish(ch, topics.MoveVerdicts, verdict)
+		if err != nil {
+			return pubsub.NackRequeue, fmt.Errorf("could not publish spawn verdict: %w", err)
+		}
+		if !verdict.Accepted {
+			return pubsub.Ack, nil
+		}
+
+		defer v.check()
+		return pubsub.Ack, fight(ledger, ch, sp.Username, []int{sp.Unit.ID}, sp.Unit.Location)
+	}
+}
+
+// spawnWait is how long a move of a unit the ledger hasn't heard of waits for
+// the unit's spawn, which reaches the server on a queue of its own.
+const spawnWait = 5 * time.Second
+
+// moveWhenSpawned applies mv, waiting up to spawnWait for the spawns of
+// units the ledger doesn't know yet.
+func moveWhenSpawned(ctx context.Context, ledger *gamelogic.Ledger, mv gamelogic.ArmyMove) error {
+	timeout := time.After(spawnWait)
+	for {
+		spawned := ledger.Spawned()
+		err := ledger.Move(mv)
+		if !errors.As(err, new(gamelogic.UnknownUnitError)) {
+			return err
+		}
+		select {
+		case <-spawned:
+		case <-timeout:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func handleLedgerMove(ledger *gamelogic.Ledger, ch *amqp.Channel, v *victory) pubsub.Handler[gamelogic.ArmyMove] {
+	return func(ctx context.Context, msg pubsub.Message[gamelogic.ArmyMove]) (pubsub.Acktype, error) {
+		mv := msg.Body
+		owner, err := routing.ParseArmyMovesKey(msg.RoutingKey)
+		if err != nil || owner != mv.Player.Username {
+			return pubsub.NackDiscard, fmt.Errorf("move by %s was published as %q", mv.Player.Username, msg.RoutingKey)
+		}
+
+		verdict := gamelogic.MoveVerdict{Move: mv, Accepted: true}
+		err = moveWhenSpawned(ctx, ledger, mv)
+		if ctx.Err() != nil || errors.Is(err, gamelogic.ErrLedgerNotSaved) {
+			return pubsub.NackRequeue, err
+		}
+		if err != nil {
+			log.Printf("Rejected move by %s: %v\n", mv.Player.Username, err)
+			verdict.Accepted = false
+			verdict.Reason = err.Error()
+		}
+		verdict.Player = ledger.Player(mv.Player.Username)
+
+		// Moves are idempotent, so a requeued move is simply applied again.
+		err = pubsub.Publish(ch, topics.MoveVerdicts, verdict)
+		if err != nil {
+			return pubsub.NackRequeue, fmt.Errorf("could not publish move verdict: %w", err)
+		}
+		if !verdict.Accepted || !mv.Arrived {
+			return pubsub.Ack, nil
+		}
+
+		ids := make([]int, 0, len(mv.Units))
+		for _, unit := range mv.Units {
+			ids = append(ids, unit.ID)
+		}
+		defer v.check()
+		return pubsub.Ack, fight(ledger, ch, mv.Player.Username, ids, mv.ToLocation)
+	}
+}
+
+// fight has the ledger fight over the location units spawned or arrived in,
+// and announces the battle. A redelivered spawn or arrival fights nothing, so
+// nothing is requeued when the outcome can't be saved or announced: players
+// catch up with their next verdict or sync.
+func fight(ledger *gamelogic.Ledger, ch *amqp.Channel, username string, ids []int, loc gamelogic.Location) error {
+	results, err := ledger.Battles(username, ids, loc)
+	if err != nil {
+		log.Println("Error saving battles:", err)
+	}
+
+	var errs []error
+	for _, result := range results {
+		errs = append(errs, announceBattle(ch, result, username))
+	}
+	return errors.Join(errs...)
+}
+
+// announceBattle tells every player the outcome of a battle and logs it.
+func announceBattle(ch *amqp.Channel, result gamelogic.BattleResult, attacker string) error {
+	description := gamelogic.DescribeBattle(result)
+	log.Println("Ledger:", description)
+
+	err := pubsub.Publish(ch, topics.Battles, result)
+	if err != nil {
+		return fmt.Errorf("could not publish battle of %s: %v", result.Location, err)
+	}
+	err = pubsub.Publish(ch, topics.GameLogs, routing.GameLog{
+		CurrentTime: time.Now(),
+		Message:     description,
+		Username:    attacker,
+	})
+	if err != nil {
+		return fmt.Errorf("could not publish battle of %s to the game log: %v", result.Location, err)
+	}
+	return nil
+}
+
+// victory announces the winner of the game, once.
+type victory struct {
+	ledger *gamelogic.Ledger
+	ch     *amqp.Channel
+
+	mu     sync.Mutex
+	winner string
+}
+
+func (v *victory) check() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	winner := v.ledger.Winner()
+	if winner == "" || winner == v.winner {
+		return
+	}
+	v.winner = winner
+
+	rules, _ := gamelogic.ActiveRuleset()
+	message := fmt.Sprintf("%s has won the game of %s", winner, rules.Name)
+	log.Println(message)
+	err := pubsub.Publish(v.ch, topics.GameLogs, routing.GameLog{
+		CurrentTime: time.Now(),
+		Message:     message,
+		Username:    winner,
+	})
+	if err != nil {
+		log.Println("Error publishing victory:", err)
+	}
+}
+
+func handleSync(ledger *gamelogic.Ledger, ch *amqp.Channel) pubsub.Handler[gamelogic.SyncRequest] {
+	return func(_ context.Context, msg pubsub.Message[gamelogic.SyncRequest]) (pubsub.Acktype, error) {
+		// Only a player's own units are sent back, to whoever the routing
+		// key says asked.
+		owner, err := routing.ParseSyncKey(msg.RoutingKey)
+		if err != nil || owner != msg.Body.Username {
+			return pubsub.NackDiscard, fmt.Errorf("sync for %s was published as %q", msg.Body.Username, msg.RoutingKey)
+		}
+
+		player, known := ledger.Lookup(msg.Body.Username)
+		reply := gamelogic.SyncReply{Player: player, Known: known}
+
+		rules, hash := gamelogic.ActiveRuleset()
+		reply.RulesHash = hash
+		if msg.Body.RulesHash != hash {
+			log.Printf("%s plays by rules %.12s instead of %.12s, sending ours\n", msg.Body.Username, msg.Body.RulesHash, hash)
+			reply.Rules = &rules
+		}
+
+		err = pubsub.Respond(ch, msg, pubsub.JSON, reply)
+		if err != nil {
+			return pubsub.NackDiscard, fmt.Errorf("could not answer sync for %s: %v", msg.Body.Username, err)
+		}
+		return pubsub.Ack, nil
+	}
+}
+
+func printLedger(ledger *gamelogic.Ledger) {
+	players := ledger.Players()
+	if len(players) == 0 {
+		fmt.Println("The ledger is empty")
+		return
+	}
+
+	for _, player := range players {
+		fmt.Printf("* %s: %d unit(s)\n", player.Username, len(player.Units))
+
+		ids := make([]int, 0, len(player.Units))
+		for id := range player.Units {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			unit := player.Units[id]
+			if unit.InTransit() {
+				fmt.Printf("    %d: %s from %s to %s, arriving at tick %d\n", unit.ID, unit.Rank, unit.Location, unit.Destination, unit.ArrivesAt)
+				continue
+			}
+			fmt.Printf("    %d: %s in %s\n", unit.ID, unit.Rank, unit.Location)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/config"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing/topics"
+)
+
+// peril-watch prints every battle and game log as it happens, over the
+// transport the configuration names, until interrupted.
+func main() {
+	cfg, err := config.Load("peril-watch", os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tenant := cfg.ParsedTenant()
+	topics.UseExchanges(cfg.Exchanges.Direct, cfg.Exchanges.Topic)
+	topics.UseTenant(tenant)
+
+	var t pubsub.Transport
+	switch cfg.Transport.Protocol {
+	case "amqp":
+		conn, err := tenant.Dial(cfg.AMQPURL, cfg.DialOptions())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+
+		t, err = pubsub.NewAMQPTransport(conn)
+		if err != nil {
+			log.Fatalf("could not open amqp transport: %v", err)
+		}
+
+	case "stomp":
+		user, password, vhost, err := brokerLogin(cfg, tenant)
+		if err != nil {
+			log.Fatal(err)
+		}
+		t, err = pubsub.DialSTOMP(cfg.Transport.Address(), user, password, vhost)
+		if err != nil {
+			log.Fatalf("could not connect to stomp broker: %v", err)
+		}
+
+	case "mqtt":
+		user, password, vhost, err := brokerLogin(cfg, tenant)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// The MQTT plugin picks the vhost from the username.
+		if vhost != "/" {
+			user = vhost + ":" + user
+		}
+		version, _ := cfg.Transport.ParsedMQTTVersion()
+		// The plugin only publishes to and consumes from its one exchange,
+		// which is why the configuration rules out prefixed tenants here.
+		t, err = pubsub.DialMQTT(cfg.Transport.Address(), topics.Battles.Exchange, pubsub.MQTTOptions{
+			ClientID:     "peril-watch-" + strconv.Itoa(os.Getpid()),
+			Username:     user,
+			Password:     password,
+			Version:      version,
+			CleanSession: true,
+		})
+		if err != nil {
+			log.Fatalf("could not connect to mqtt broker: %v", err)
+		}
+	}
+	defer t.Close()
+
+	log.Printf("Watching tenant %s over %s\n", tenant, cfg.Transport.Protocol)
+
+	// Several watchers may run at once, each with queues of its own.
+	id := strconv.Itoa(os.Getpid())
+
+	err = pubsub.SubscribeVia(
+		t,
+		topics.Battles,
+		tenant.Queue(routing.WatchQueue(routing.BattlesPrefix, id)),
+		pubsub.Transient,
+		func(b gamelogic.BattleResult) pubsub.Acktype {
+			log.Println(gamelogic.DescribeBattle(b))
+			return pubsub.Ack
+		},
+	)
+	if err != nil {
+		log.Fatalf("could not subscribe to battles: %v", err)
+	}
+
+	err = pubsub.SubscribeVia(
+		t,
+		topics.GameLogs,
+		tenant.Queue(routing.WatchQueue(routing.GameLogSlug, id)),
+		pubsub.Transient,
+		func(gl routing.GameLog) pubsub.Acktype {
+			fmt.Printf("%v %s: %s\n", gl.CurrentTime.Format("15:04:05"), gl.Username, gl.Message)
+			return pubsub.Ack
+		},
+	)
+	if err != nil {
+		log.Fatalf("could not subscribe to game logs: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	log.Println("Stopped watching")
+}
+
+// brokerLogin returns the user, password and vhost of the amqp url for
+// transports that can't dial it themselves.
+func brokerLogin(cfg config.Config, tenant pubsub.Tenant) (user, password, vhost string, err error) {
+	raw, err := tenant.URL(cfg.AMQPURL)
+	if err != nil {
+		return "", "", "", err
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		// url.Parse errors quote the url, password included.
+		return "", "", "", errors.New("could not parse broker url")
+	}
+
+	user = u.User.Username()
+	password, _ = u.User.Password()
+	if provider := cfg.DialOptions().Credentials; provider != nil {
+		creds, err := provider.Credentials(context.Background())
+		if err != nil {
+			return "", "", "", fmt.Errorf("could not get broker credentials: %v", err)
+		}
+		user, password = creds.Username, creds.Password
+	}
+
+	vhost = strings.TrimPrefix(u.Path, "/")
+	if vhost == "" {
+		vhost = "/"
+	}
+	return user, password, vhost, nil
+}
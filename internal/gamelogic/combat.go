@@ -0,0 +1,387 @@
+package gamelogic
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"sort"
+	"strings"
+)
+
+// Battle is a fight in one location between every player with units there.
+// Allies fight on the same side, and everyone else on a side of their own.
+type Battle struct {
+	Location Location
+	// Attacker is the player whose arrival or spawn started the battle, if
+	// any. Everyone else defends.
+	Attacker string
+	Sides    []Side
+}
+
+// Side is the players fighting together in a battle, sorted by username.
+type Side struct {
+	Players []Player
+}
+
+// NewBattle gathers the players with units in loc into sides by the rules'
+// alliances. Sides are sorted by their first player, so the same players
+// always make the same battle. It has fewer than two sides when nobody in
+// loc is at war.
+func NewBattle(loc Location, attacker string, players []Player) Battle {
+	present := []Player{}
+	for _, p := range players {
+		if len(unitsIn(p, loc)) > 0 {
+			present = append(present, p)
+		}
+	}
+	sort.Slice(present, func(i, j int) bool { return present[i].Username < present[j].Username })
+
+	b := Battle{Location: loc, Attacker: attacker}
+	index := map[sideKey]int{}
+	for _, p := range present {
+		key := sideOf(p.Username)
+		i, ok := index[key]
+		if !ok {
+			i = len(b.Sides)
+			index[key] = i
+			b.Sides = append(b.Sides, Side{})
+		}
+		b.Sides[i].Players = append(b.Sides[i].Players, p)
+	}
+	return b
+}
+
+func (s Side) has(username string) bool {
+	for _, p := range s.Players {
+		if p.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Side) usernames() []string {
+	usernames := make([]string, 0, len(s.Players))
+	for _, p := range s.Players {
+		usernames = append(usernames, p.Username)
+	}
+	return usernames
+}
+
+// fighter is a unit in a battle. Unit IDs are only unique per player, so it
+// carries its owner along.
+type fighter struct {
+	username string
+	Unit
+}
+
+func (s Side) fighters(loc Location) []fighter {
+	fighters := []fighter{}
+	for _, p := range s.Players {
+		for _, unit := range unitsIn(p, loc) {
+			fighters = append(fighters, fighter{username: p.Username, Unit: unit})
+		}
+	}
+	return sortedByStrength(fighters)
+}
+
+// BattleResult is what a CombatResolver decided, and what the server tells
+// every player about a battle.
+type BattleResult struct {
+	Location Location
+	Resolver string
+	// Winners are the players on the winning side, none on a draw.
+	Winners []string
+	Draw    bool
+	// Casualties lists the IDs of the units each player lost, and Survivors
+	// the IDs of those they still have in Location, by username. Every
+	// player who fought is in Survivors.
+	Casualties map[string][]int
+	Survivors  map[string][]int
+}
+
+// result fills in the winners and survivors of b once the casualties are
+// known. winner is the index of the winning side, or -1 on a draw.
+func (b Battle) result(resolver string, winner int, casualties map[string][]int) BattleResult {
+	result := BattleResult{
+		Location:   b.Location,
+		Resolver:   resolver,
+		Draw:       winner < 0,
+		Casualties: casualties,
+		Survivors:  map[string][]int{},
+	}
+	if winner >= 0 {
+		result.Winners = b.Sides[winner].usernames()
+	}
+
+	for _, side := range b.Sides {
+		for _, p := range side.Players {
+			dead := map[int]bool{}
+			for _, id := range casualties[p.Username] {
+				dead[id] = true
+			}
+			survivors := []int{}
+			for _, id := range unitIDs(unitsIn(p, b.Location)) {
+				if !dead[id] {
+					survivors = append(survivors, id)
+				}
+			}
+			result.Survivors[p.Username] = survivors
+		}
+	}
+	return result
+}
+
+// CombatResolver decides battles. Resolvers must be deterministic: the same
+// battle always ends the same way.
+type CombatResolver interface {
+	Name() string
+	Resolve(b Battle) BattleResult
+}
+
+// PowerResolver is the classic combat: the side with the most power wipes
+// out every other, and a tie for the most wipes out everyone.
+type PowerResolver struct{}
+
+func (PowerResolver) Name() string {
+	return "power"
+}
+
+func (PowerResolver) Resolve(b Battle) BattleResult {
+	powers := make([]int, len(b.Sides))
+	for i, side := range b.Sides {
+		powers[i] = fightersToPowerLevel(side.fighters(b.Location))
+	}
+	winner := strongest(powers)
+
+	casualties := map[string][]int{}
+	for i, side := range b.Sides {
+		if i == winner {
+			continue
+		}
+		for _, p := range side.Players {
+			casualties[p.Username] = unitIDs(unitsIn(p, b.Location))
+		}
+	}
+	return b.result("power", winner, casualties)
+}
+
+// DiceResolver fights a battle in rounds. Each round every side still
+// standing rolls a die per unit and adds its power, defending units add
+// DefenderBonus, and units facing a rank they counter add the counter's
+// bonus. The side with the lowest total loses its weakest unit, and sides
+// tied for the lowest each lose one. The battle ends when one side is left or
+// after Rounds rounds, when the side with the most power left wins.
+//
+// The dice are seeded from Seed and the battle itself, so the same battle
+// always rolls the same numbers.
+type DiceResolver struct {
+	Seed          uint64
+	Rounds        int
+	DefenderBonus int
+	Counters      []Counter
+}
+
+func (DiceResolver) Name() string {
+	return "dice"
+}
+
+func (d DiceResolver) Resolve(b Battle) BattleResult {
+	forces := make([][]fighter, len(b.Sides))
+	for i, side := range b.Sides {
+		forces[i] = side.fighters(b.Location)
+	}
+	rng := rand.New(rand.NewPCG(d.Seed, battleSeed(b, forces)))
+
+	casualties := map[string][]int{}
+	rounds := d.Rounds
+	if rounds < 1 {
+		rounds = 3
+	}
+	for range rounds {
+		standing := 0
+		for _, force := range forces {
+			if len(force) > 0 {
+				standing++
+			}
+		}
+		if standing < 2 {
+			break
+		}
+
+		rolls := make([]int, len(forces))
+		lowest := -1
+		for i, force := range forces {
+			if len(force) == 0 {
+				continue
+			}
+			enemies := []fighter{}
+			for j, other := range forces {
+				if j != i {
+					enemies = append(enemies, other...)
+				}
+			}
+			bonus := d.DefenderBonus
+			if b.Sides[i].has(b.Attacker) {
+				bonus = 0
+			}
+			rolls[i] = d.roll(rng, force, enemies, bonus)
+			if lowest < 0 || rolls[i] < lowest {
+				lowest = rolls[i]
+			}
+		}
+
+		for i, force := range forces {
+			if len(force) > 0 && rolls[i] == lowest {
+				fallen := force[0]
+				casualties[fallen.username] = append(casualties[fallen.username], fallen.ID)
+				forces[i] = force[1:]
+			}
+		}
+	}
+
+	powers := make([]int, len(forces))
+	for i, force := range forces {
+		// A side with nothing left can't tie with one that has units
+		// worth no power.
+		powers[i] = -1
+		if len(force) > 0 {
+			powers[i] = fightersToPowerLevel(force)
+		}
+	}
+	for username, ids := range casualties {
+		sort.Ints(ids)
+		casualties[username] = ids
+	}
+	return b.result("dice", strongest(powers), casualties)
+}
+
+func (d DiceResolver) roll(rng *rand.Rand, force, enemies []fighter, bonus int) int {
+	total := 0
+	for _, f := range force {
+		rule, _ := rankRule(f.Rank)
+		total += rng.IntN(6) + 1 + rule.Power + bonus + d.counterBonus(f.Rank, enemies)
+	}
+	return total
+}
+
+// counterBonus is the best bonus rank gets against any of enemies.
+func (d DiceResolver) counterBonus(rank UnitRank, enemies []fighter) int {
+	best := 0
+	for _, c := range d.Counters {
+		if c.Rank != rank {
+			continue
+		}
+		for _, enemy := range enemies {
+			if enemy.Rank == c.Against {
+				best = max(best, c.Bonus)
+				break
+			}
+		}
+	}
+	return best
+}
+
+// strongest returns the index of the side with the most power, or -1 when
+// sides tie for the most.
+func strongest(powers []int) int {
+	best := -1
+	tied := false
+	for i, power := range powers {
+		switch {
+		case best < 0 || power > powers[best]:
+			best, tied = i, false
+		case power == powers[best]:
+			tied = true
+		}
+	}
+	if tied {
+		return -1
+	}
+	return best
+}
+
+// sortedByStrength sorts fighters weakest first, then by owner and ID, which
+// is the order they fall in.
+func sortedByStrength(fighters []fighter) []fighter {
+	sort.Slice(fighters, func(i, j int) bool {
+		pi, _ := rankRule(fighters[i].Rank)
+		pj, _ := rankRule(fighters[j].Rank)
+		if pi.Power != pj.Power {
+			return pi.Power < pj.Power
+		}
+		if fighters[i].username != fighters[j].username {
+			return fighters[i].username < fighters[j].username
+		}
+		return fighters[i].ID < fighters[j].ID
+	})
+	return fighters
+}
+
+// battleSeed identifies a battle by where it is, who attacks, and who fights
+// on which side with which units.
+func battleSeed(b Battle, forces [][]fighter) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(b.Location))
+	h.Write([]byte{0})
+	h.Write([]byte(b.Attacker))
+	for _, force := range forces {
+		h.Write([]byte{1})
+		for _, f := range force {
+			h.Write([]byte{0})
+			h.Write([]byte(f.username))
+			h.Write([]byte{0})
+			h.Write([]byte(f.Rank))
+			h.Write([]byte{byte(f.ID), byte(f.ID >> 8), byte(f.ID >> 16), byte(f.ID >> 24)})
+		}
+	}
+	return h.Sum64()
+}
+
+func fightersToPowerLevel(fighters []fighter) int {
+	power := 0
+	for _, f := range fighters {
+		rule, _ := rankRule(f.Rank)
+		power += rule.Power
+	}
+	return power
+}
+
+func unitIDs(units []Unit) []int {
+	ids := make([]int, 0, len(units))
+	for _, unit := range units {
+		ids = append(ids, unit.ID)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// DescribeBattle sums up a battle for game logs.
+func DescribeBattle(b BattleResult) string {
+	usernames := make([]string, 0, len(b.Survivors))
+	for username := range b.Survivors {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	description := fmt.Sprintf("battle of %s between %s with %s combat: ", b.Location, strings.Join(usernames, ", "), b.Resolver)
+	if b.Draw {
+		description += "draw"
+	} else {
+		description += strings.Join(b.Winners, " and ") + " won"
+	}
+
+	survivors := []string{}
+	for _, username := range usernames {
+		if n := len(b.Casualties[username]); n > 0 {
+			description += fmt.Sprintf(", %s lost %d unit(s)", username, n)
+		}
+		if n := len(b.Survivors[username]); n > 0 {
+			survivors = append(survivors, fmt.Sprintf("%s %d", username, n))
+		}
+	}
+	if len(survivors) == 0 {
+		return description + ", no survivors"
+	}
+	return description + ", survivors: " + strings.Join(survivors, ", ")
+}
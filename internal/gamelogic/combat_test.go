@@ -0,0 +1,190 @@
+package gamelogic
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// army returns a player with units of ranks in loc, numbered from 1.
+func army(username string, loc Location, ranks ...UnitRank) Player {
+	p := Player{Username: username, Units: map[int]Unit{}}
+	for i, rank := range ranks {
+		p.Units[i+1] = Unit{ID: i + 1, Rank: rank, Location: loc}
+	}
+	return p
+}
+
+func TestPowerResolver(t *testing.T) {
+	tests := []struct {
+		name       string
+		players    []Player
+		winners    []string
+		casualties map[string][]int
+		survivors  map[string][]int
+	}{
+		{
+			name:       "stronger side wins",
+			players:    []Player{army("alice", "asia", RankCavalry), army("bob", "asia", RankInfantry, RankInfantry)},
+			winners:    []string{"alice"},
+			casualties: map[string][]int{"bob": {1, 2}},
+			survivors:  map[string][]int{"alice": {1}, "bob": {}},
+		},
+		{
+			name:       "tie wipes out everyone",
+			players:    []Player{army("alice", "asia", RankCavalry), army("bob", "asia", RankInfantry, RankInfantry, RankInfantry, RankInfantry, RankInfantry)},
+			casualties: map[string][]int{"alice": {1}, "bob": {1, 2, 3, 4, 5}},
+			survivors:  map[string][]int{"alice": {}, "bob": {}},
+		},
+		{
+			name: "only units in the location fight",
+			players: []Player{
+				army("alice", "asia", RankInfantry),
+				{Username: "bob", Units: map[int]Unit{
+					1: {ID: 1, Rank: RankArtillery, Location: "europe"},
+					2: {ID: 2, Rank: RankCavalry, Location: "asia", Destination: "europe"},
+					3: {ID: 3, Rank: RankInfantry, Location: "asia"},
+					4: {ID: 4, Rank: RankInfantry, Location: "asia"},
+				}},
+			},
+			winners:    []string{"bob"},
+			casualties: map[string][]int{"alice": {1}},
+			survivors:  map[string][]int{"alice": {}, "bob": {3, 4}},
+		},
+		{
+			name:       "every other side loses",
+			players:    []Player{army("alice", "asia", RankInfantry), army("bob", "asia", RankArtillery), army("carol", "asia", RankCavalry)},
+			winners:    []string{"bob"},
+			casualties: map[string][]int{"alice": {1}, "carol": {1}},
+			survivors:  map[string][]int{"alice": {}, "bob": {1}, "carol": {}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBattle("asia", "alice", tt.players)
+			got := PowerResolver{}.Resolve(b)
+
+			if got.Location != "asia" || got.Resolver != "power" {
+				t.Errorf("battle of %s by %s, want asia by power", got.Location, got.Resolver)
+			}
+			if got.Draw != (len(tt.winners) == 0) || !slices.Equal(got.Winners, tt.winners) {
+				t.Errorf("winners %v, draw %v, want %v", got.Winners, got.Draw, tt.winners)
+			}
+			if !reflect.DeepEqual(got.Casualties, tt.casualties) {
+				t.Errorf("casualties %v, want %v", got.Casualties, tt.casualties)
+			}
+			if !reflect.DeepEqual(got.Survivors, tt.survivors) {
+				t.Errorf("survivors %v, want %v", got.Survivors, tt.survivors)
+			}
+		})
+	}
+}
+
+func TestDiceResolver(t *testing.T) {
+	tests := []struct {
+		name       string
+		resolver   DiceResolver
+		attacker   Player
+		defender   Player
+		winners    []string
+		casualties map[string][]int
+	}{
+		{
+			// The attacker always rolls lowest, and loses its weakest unit
+			// every round.
+			name:       "defender bonus",
+			resolver:   DiceResolver{Rounds: 3, DefenderBonus: 100},
+			attacker:   army("alice", "asia", RankArtillery, RankInfantry),
+			defender:   army("bob", "asia", RankInfantry),
+			winners:    []string{"bob"},
+			casualties: map[string][]int{"alice": {1, 2}},
+		},
+		{
+			name:       "counters",
+			resolver:   DiceResolver{Rounds: 3, Counters: []Counter{{Rank: RankInfantry, Against: RankCavalry, Bonus: 100}}},
+			attacker:   army("alice", "asia", RankInfantry),
+			defender:   army("bob", "asia", RankCavalry, RankCavalry),
+			winners:    []string{"alice"},
+			casualties: map[string][]int{"bob": {1, 2}},
+		},
+		{
+			name:       "rounds run out",
+			resolver:   DiceResolver{Rounds: 1, DefenderBonus: 100},
+			attacker:   army("alice", "asia", RankInfantry, RankArtillery),
+			defender:   army("bob", "asia", RankInfantry),
+			winners:    []string{"alice"},
+			casualties: map[string][]int{"alice": {1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBattle("asia", tt.attacker.Username, []Player{tt.attacker, tt.defender})
+			got := tt.resolver.Resolve(b)
+
+			if got.Resolver != "dice" || got.Draw || !slices.Equal(got.Winners, tt.winners) {
+				t.Errorf("%s winners %v, draw %v, want %v", got.Resolver, got.Winners, got.Draw, tt.winners)
+			}
+			if !reflect.DeepEqual(got.Casualties, tt.casualties) {
+				t.Errorf("casualties %v, want %v", got.Casualties, tt.casualties)
+			}
+		})
+	}
+}
+
+func TestDiceResolverIsDeterministic(t *testing.T) {
+	players := []Player{
+		army("alice", "asia", RankInfantry, RankCavalry, RankCavalry),
+		army("bob", "asia", RankInfantry, RankCavalry, RankCavalry),
+	}
+	b := NewBattle("asia", "alice", players)
+
+	outcomes := map[string]bool{}
+	for seed := range uint64(20) {
+		d := DiceResolver{Seed: seed, Rounds: 5}
+		first := d.Resolve(b)
+		if again := d.Resolve(b); !reflect.DeepEqual(first, again) {
+			t.Fatalf("seed %d: the same battle ended as %+v and as %+v", seed, first, again)
+		}
+
+		// Every unit either fell or survived, and no side lost more units
+		// than there were rounds.
+		for _, p := range players {
+			fell := first.Casualties[p.Username]
+			if len(fell) > d.Rounds {
+				t.Errorf("seed %d: %s lost %d units in %d rounds", seed, p.Username, len(fell), d.Rounds)
+			}
+			all := slices.Concat(fell, first.Survivors[p.Username])
+			slices.Sort(all)
+			if !slices.Equal(all, unitIDs(unitsIn(p, "asia"))) {
+				t.Errorf("seed %d: %s has casualties %v and survivors %v", seed, p.Username, fell, first.Survivors[p.Username])
+			}
+		}
+		outcomes[fmt.Sprint(first.Casualties)] = true
+	}
+	if len(outcomes) < 2 {
+		t.Error("every seed rolled the same battle")
+	}
+}
+
+func TestStrongest(t *testing.T) {
+	tests := []struct {
+		powers []int
+		want   int
+	}{
+		{[]int{3, 5}, 1},
+		{[]int{5, 3, 1}, 0},
+		{[]int{5, 5}, -1},
+		{[]int{1, 5, 5}, -1},
+		{[]int{5, 5, 6}, 2},
+		{[]int{-1, 0}, 1},
+	}
+
+	for _, tt := range tests {
+		if got := strongest(tt.powers); got != tt.want {
+			t.Errorf("strongest(%v) = %d, want %d", tt.powers, got, tt.want)
+		}
+	}
+}
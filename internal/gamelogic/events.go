@@ -0,0 +1,216 @@
+package gamelogic
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Event is one change to a GameState. A GameState never changes other than by
+// recording an event, so its events replay into exactly the same state.
+type Event interface {
+	eventType() string
+}
+
+type UnitSpawned struct {
+	Unit Unit
+}
+
+type UnitMoved struct {
+	UnitID int
+	From   Location
+	To     Location
+}
+
+type UnitDeparted struct {
+	UnitID    int
+	To        Location
+	ArrivesAt Tick
+}
+
+type UnitArrived struct {
+	UnitID int
+}
+
+type UnitsDestroyed struct {
+	Location Location
+	UnitIDs  []int
+}
+
+// UnitsSynced replaces every unit, for example with the server's view of
+// them.
+type UnitsSynced struct {
+	Units []Unit
+}
+
+type GamePaused struct{}
+
+type GameResumed struct{}
+
+func (UnitSpawned) eventType() string    { return "unit_spawned" }
+func (UnitMoved) eventType() string      { return "unit_moved" }
+func (UnitDeparted) eventType() string   { return "unit_departed" }
+func (UnitArrived) eventType() string    { return "unit_arrived" }
+func (UnitsDestroyed) eventType() string { return "units_destroyed" }
+func (UnitsSynced) eventType() string    { return "units_synced" }
+func (GamePaused) eventType() string     { return "game_paused" }
+func (GameResumed) eventType() string    { return "game_resumed" }
+
+// State is what a player's events add up to.
+type State struct {
+	Username string
+	Units    map[int]Unit
+	Paused   bool
+}
+
+func NewState(username string) State {
+	return State{Username: username, Units: map[int]Unit{}}
+}
+
+// Apply returns s after e. It never modifies s, so earlier states stay valid.
+func Apply(s State, e Event) State {
+	units := make(map[int]Unit, len(s.Units))
+	for id, unit := range s.Units {
+		units[id] = unit
+	}
+	s.Units = units
+
+	switch e := e.(type) {
+	case UnitSpawned:
+		s.Units[e.Unit.ID] = e.Unit
+	case UnitMoved:
+		if unit, ok := s.Units[e.UnitID]; ok {
+			unit.Location = e.To
+			s.Units[e.UnitID] = unit
+		}
+	case UnitDeparted:
+		if unit, ok := s.Units[e.UnitID]; ok {
+			unit.Destination = e.To
+			unit.ArrivesAt = e.ArrivesAt
+			s.Units[e.UnitID] = unit
+		}
+	case UnitArrived:
+		if unit, ok := s.Units[e.UnitID]; ok && unit.InTransit() {
+			unit.Location = unit.Destination
+			unit.Destination = ""
+			unit.ArrivesAt = 0
+			s.Units[e.UnitID] = unit
+		}
+	case UnitsDestroyed:
+		for _, id := range e.UnitIDs {
+			delete(s.Units, id)
+		}
+	case UnitsSynced:
+		clear(s.Units)
+		for _, unit := range e.Units {
+			s.Units[unit.ID] = unit
+		}
+	case GamePaused:
+		s.Paused = true
+	case GameResumed:
+		s.Paused = false
+	}
+	return s
+}
+
+// Replay applies events to a new state, in order.
+func Replay(username string, events []RecordedEvent) State {
+	s := NewState(username)
+	for _, r := range events {
+		s = Apply(s, r.Event)
+	}
+	return s
+}
+
+// RecordedEvent is an event in a GameState's history. It is encoded to JSON
+// with its type, so histories can be stored and read back.
+type RecordedEvent struct {
+	Seq   int
+	At    time.Time
+	Event Event
+}
+
+type recordedEventJSON struct {
+	Seq   int
+	At    time.Time
+	Type  string
+	Event json.RawMessage
+}
+
+func (r RecordedEvent) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(r.Event)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(recordedEventJSON{
+		Seq:   r.Seq,
+		At:    r.At,
+		Type:  r.Event.eventType(),
+		Event: data,
+	})
+}
+
+func (r *RecordedEvent) UnmarshalJSON(b []byte) error {
+	var raw recordedEventJSON
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	var e Event
+	var err error
+	switch raw.Type {
+	case "unit_spawned":
+		e, err = decodeEvent[UnitSpawned](raw.Event)
+	case "unit_moved":
+		e, err = decodeEvent[UnitMoved](raw.Event)
+	case "unit_departed":
+		e, err = decodeEvent[UnitDeparted](raw.Event)
+	case "unit_arrived":
+		e, err = decodeEvent[UnitArrived](raw.Event)
+	case "units_destroyed":
+		e, err = decodeEvent[UnitsDestroyed](raw.Event)
+	case "units_synced":
+		e, err = decodeEvent[UnitsSynced](raw.Event)
+	case "game_paused":
+		e = GamePaused{}
+	case "game_resumed":
+		e = GameResumed{}
+	default:
+		return fmt.Errorf("unknown event type %q", raw.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("could not decode %s event: %v", raw.Type, err)
+	}
+
+	*r = RecordedEvent{Seq: raw.Seq, At: raw.At, Event: e}
+	return nil
+}
+
+func decodeEvent[E Event](data json.RawMessage) (Event, error) {
+	var e E
+	err := json.Unmarshal(data, &e)
+	return e, err
+}
+
+func (r RecordedEvent) String() string {
+	var desc string
+	switch e := r.Event.(type) {
+	case UnitSpawned:
+		desc = fmt.Sprintf("spawned %s %d in %s", e.Unit.Rank, e.Unit.ID, e.Unit.Location)
+	case UnitMoved:
+		desc = fmt.Sprintf("moved unit %d from %s to %s", e.UnitID, e.From, e.To)
+	case UnitDeparted:
+		desc = fmt.Sprintf("unit %d set off for %s, arriving at tick %d", e.UnitID, e.To, e.ArrivesAt)
+	case UnitArrived:
+		desc = fmt.Sprintf("unit %d arrived", e.UnitID)
+	case UnitsDestroyed:
+		desc = fmt.Sprintf("lost %d unit(s) in %s", len(e.UnitIDs), e.Location)
+	case UnitsSynced:
+		desc = fmt.Sprintf("synced %d unit(s) with the server", len(e.Units))
+	case GamePaused:
+		desc = "game paused"
+	case GameResumed:
+		desc = "game resumed"
+	}
+	return fmt.Sprintf("#%d %s %s", r.Seq, r.At.Format(time.TimeOnly), desc)
+}
@@ -0,0 +1,96 @@
+package gamelogic
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApply(t *testing.T) {
+	infantry := Unit{ID: 1, Rank: RankInfantry, Location: "europe"}
+	cavalry := Unit{ID: 2, Rank: RankCavalry, Location: "europe"}
+	travelling := Unit{ID: 1, Rank: RankInfantry, Location: "europe", Destination: "asia", ArrivesAt: 10}
+
+	state := func(paused bool, units ...Unit) State {
+		s := NewState("alice")
+		s.Paused = paused
+		for _, unit := range units {
+			s.Units[unit.ID] = unit
+		}
+		return s
+	}
+
+	tests := []struct {
+		name   string
+		before State
+		event  Event
+		want   State
+	}{
+		{"spawn", state(false), UnitSpawned{infantry}, state(false, infantry)},
+		{"move", state(false, infantry), UnitMoved{UnitID: 1, From: "europe", To: "asia"}, state(false, Unit{ID: 1, Rank: RankInfantry, Location: "asia"})},
+		{"move unknown unit", state(false, infantry), UnitMoved{UnitID: 9, To: "asia"}, state(false, infantry)},
+		{"depart", state(false, infantry), UnitDeparted{UnitID: 1, To: "asia", ArrivesAt: 10}, state(false, travelling)},
+		{"arrive", state(false, travelling), UnitArrived{UnitID: 1}, state(false, Unit{ID: 1, Rank: RankInfantry, Location: "asia"})},
+		{"arrive when not travelling", state(false, infantry), UnitArrived{UnitID: 1}, state(false, infantry)},
+		{"destroy", state(false, infantry, cavalry), UnitsDestroyed{Location: "europe", UnitIDs: []int{1}}, state(false, cavalry)},
+		{"sync", state(false, infantry), UnitsSynced{Units: []Unit{cavalry}}, state(false, cavalry)},
+		{"sync nothing", state(false, infantry, cavalry), UnitsSynced{}, state(false)},
+		{"pause", state(false, infantry), GamePaused{}, state(true, infantry)},
+		{"resume", state(true), GameResumed{}, state(false)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := state(tt.before.Paused)
+			for id, unit := range tt.before.Units {
+				before.Units[id] = unit
+			}
+
+			got := Apply(tt.before, tt.event)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.before, before) {
+				t.Errorf("Apply modified its input: %+v, was %+v", tt.before, before)
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	events := []RecordedEvent{
+		{Seq: 1, At: at, Event: UnitSpawned{Unit{ID: 1, Rank: RankInfantry, Location: "europe"}}},
+		{Seq: 2, At: at, Event: UnitSpawned{Unit{ID: 2, Rank: RankCavalry, Location: "europe"}}},
+		{Seq: 3, At: at, Event: UnitDeparted{UnitID: 1, To: "asia", ArrivesAt: 10}},
+		{Seq: 4, At: at, Event: GamePaused{}},
+		{Seq: 5, At: at, Event: UnitArrived{UnitID: 1}},
+		{Seq: 6, At: at, Event: UnitsDestroyed{Location: "europe", UnitIDs: []int{2}}},
+	}
+	want := State{
+		Username: "alice",
+		Units:    map[int]Unit{1: {ID: 1, Rank: RankInfantry, Location: "asia"}},
+		Paused:   true,
+	}
+
+	if got := Replay("alice", events); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replay = %+v, want %+v", got, want)
+	}
+
+	// A history survives being saved and read back.
+	data, err := json.Marshal(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []RecordedEvent
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, events) {
+		t.Errorf("decoded %+v, want %+v", decoded, events)
+	}
+	if got := Replay("alice", decoded); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replay of the decoded history = %+v, want %+v", got, want)
+	}
+}
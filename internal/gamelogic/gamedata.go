@@ -17,36 +17,66 @@ type Unit struct {
 	ID       int
 	Rank     UnitRank
 	Location Location
+	// Destination is set while the unit travels. It left Location and is in
+	// no location until it reaches Destination at ArrivesAt.
+	Destination Location
+	ArrivesAt   Tick
 }
 
+func (u Unit) InTransit() bool {
+	return u.Destination != ""
+}
+
+// At reports whether the unit is in loc, rather than travelling from it.
+func (u Unit) At(loc Location) bool {
+	return !u.InTransit() && u.Location == loc
+}
+
+// ArmyMove is sent twice for every move: when the units set off along Path
+// at DepartedAt by the mover's clock, and with Arrived set when they reach
+// ToLocation. The server times the journey from when it hears of the
+// departure. Only arrivals can start a war.
 type ArmyMove struct {
 	Player     Player
 	Units      []Unit
 	ToLocation Location
+	Path       []Location
+	DepartedAt Tick
+	Arrived    bool
+}
+
+// ArmySpawn reports a unit a player spawned.
+type ArmySpawn struct {
+	Username string
+	Unit     Unit
 }
 
-type RecognitionOfWar struct {
-	Attacker Player
-	Defender Player
+// MoveVerdict is the server's answer to an ArmyMove, or to an ArmySpawn when
+// Spawn is set. Player is the mover as the server knows them after the move
+// or spawn was applied or rejected.
+type MoveVerdict struct {
+	Move     ArmyMove
+	Spawn    *ArmySpawn `json:",omitempty"`
+	Accepted bool
+	Reason   string
+	Player   Player
 }
 
 type Location string
 
 func getAllRanks() map[UnitRank]struct{} {
-	return map[UnitRank]struct{}{
-		RankInfantry:  {},
-		RankCavalry:   {},
-		RankArtillery: {},
+	rules, _ := ActiveRuleset()
+	ranks := map[UnitRank]struct{}{}
+	for _, rank := range rules.Ranks {
+		ranks[rank.Name] = struct{}{}
 	}
+	return ranks
 }
 
 func getAllLocations() map[Location]struct{} {
-	return map[Location]struct{}{
-		"americas":   {},
-		"europe":     {},
-		"africa":     {},
-		"asia":       {},
-		"australia":  {},
-		"antarctica": {},
+	locations := map[Location]struct{}{}
+	for _, loc := range currentMap().Locations() {
+		locations[loc] = struct{}{}
 	}
+	return locations
 }
@@ -6,18 +6,35 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"strconv"
 	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 )
 
 func PrintClientHelp() {
 	fmt.Println("Possible commands:")
 	fmt.Println("* move <location> <unitID> <unitID> <unitID>...")
+	fmt.Println("    units travel along the fastest route and only fight")
+	fmt.Println("    once they arrive")
 	fmt.Println("    example:")
 	fmt.Println("    move asia 1")
 	fmt.Println("* spawn <location> <rank>")
 	fmt.Println("    example:")
 	fmt.Println("    spawn europe infantry")
 	fmt.Println("* status")
+	fmt.Println("* history [n]")
+	fmt.Println("    lists everything that happened to your units, or shows")
+	fmt.Println("    them as they were right after event n")
+	fmt.Println("* save [file]")
+	fmt.Println("* load [file]")
+	fmt.Println("    the game is also saved on quit and loaded on start;")
+	fmt.Println("    loaded units are checked with the server")
+	fmt.Println("* outbox")
+	fmt.Println("    lists messages waiting for the broker")
+	fmt.Println("* flush")
+	fmt.Println("    publishes waiting messages right away")
+	fmt.Println("* stats")
 	fmt.Println("* spam <n>")
 	fmt.Println("    example:")
 	fmt.Println("    spam 5")
@@ -25,14 +42,21 @@ func PrintClientHelp() {
 	fmt.Println("* help")
 }
 
-func ClientWelcome() (string, error) {
+// ClientWelcome greets the player, asking for their username unless one is
+// given.
+func ClientWelcome(username string) (string, error) {
 	fmt.Println("Welcome to the Peril client!")
-	fmt.Println("Please enter your username:")
-	words := GetInput()
-	if len(words) == 0 {
-		return "", errors.New("you must enter a username. goodbye")
+	if username == "" {
+		fmt.Println("Please enter your username:")
+		words := GetInput()
+		if len(words) == 0 {
+			return "", errors.New("you must enter a username. goodbye")
+		}
+		username = words[0]
+	}
+	if err := routing.ValidateUsername(username); err != nil {
+		return "", err
 	}
-	username := words[0]
 	fmt.Printf("Welcome, %s!\n", username)
 	PrintClientHelp()
 	return username, nil
@@ -40,8 +64,18 @@ func ClientWelcome() (string, error) {
 
 func PrintServerHelp() {
 	fmt.Println("Possible commands:")
-	fmt.Println("* pause")
-	fmt.Println("* resume")
+	fmt.Println("* pause [player...]")
+	fmt.Println("* resume [player...]")
+	fmt.Println("    named players are expected to acknowledge, along with")
+	fmt.Println("    every player that acknowledged before")
+	fmt.Println("* rebuild")
+	fmt.Println("    replaces the log file with the game log stream, replayed")
+	fmt.Println("    from its first entry")
+	fmt.Println("* dlq [n]")
+	fmt.Println("    shows up to n (default 10) dead-lettered messages")
+	fmt.Println("* ledger")
+	fmt.Println("    shows every player's units as the server knows them")
+	fmt.Println("* stats")
 	fmt.Println("* quit")
 	fmt.Println("* help")
 }
@@ -58,6 +92,21 @@ func GetInput() []string {
 	return strings.Fields(line)
 }
 
+// Inputs reads commands from stdin in the background, so a program can wait
+// for the next command and for other things, such as a signal, at once. It
+// doesn't print a prompt. The channel is closed with stdin.
+func Inputs() <-chan []string {
+	inputs := make(chan []string)
+	go func() {
+		defer close(inputs)
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			inputs <- strings.Fields(scanner.Text())
+		}
+	}()
+	return inputs
+}
+
 func GetMaliciousLog() string {
 	possibleLogs := []string{
 		"Never interrupt your enemy when he is making a mistake.",
@@ -77,7 +126,7 @@ func PrintQuit() {
 }
 
 func (gs *GameState) CommandStatus() {
-	if gs.isPaused() {
+	if gs.IsPaused() {
 		fmt.Println("The game is paused.")
 		return
 	} else {
@@ -87,6 +136,46 @@ func (gs *GameState) CommandStatus() {
 	p := gs.GetPlayerSnap()
 	fmt.Printf("You are %s, and you have %d units.\n", p.Username, len(p.Units))
 	for _, unit := range p.Units {
-		fmt.Printf("* %v: %v, %v\n", unit.ID, unit.Location, unit.Rank)
+		printUnit(unit)
+	}
+}
+
+func (gs *GameState) CommandHistory(words []string) error {
+	if len(words) < 2 {
+		events := gs.Events()
+		fmt.Printf("%d event(s):\n", len(events))
+		for _, e := range events {
+			fmt.Printf("* %v\n", e)
+		}
+		return nil
+	}
+
+	seq, err := strconv.Atoi(words[1])
+	if err != nil {
+		return fmt.Errorf("error: %s is not an event number", words[1])
+	}
+	s, err := gs.StateAt(seq)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("After event #%d the game was ", seq)
+	if s.Paused {
+		fmt.Println("paused.")
+	} else {
+		fmt.Println("not paused.")
+	}
+	fmt.Printf("You had %d units.\n", len(s.Units))
+	for _, unit := range s.Units {
+		printUnit(unit)
+	}
+	return nil
+}
+
+func printUnit(unit Unit) {
+	if unit.InTransit() {
+		fmt.Printf("* %v: %v -> %v (arrives at tick %d), %v\n", unit.ID, unit.Location, unit.Destination, unit.ArrivesAt, unit.Rank)
+		return
 	}
+	fmt.Printf("* %v: %v, %v\n", unit.ID, unit.Location, unit.Rank)
 }
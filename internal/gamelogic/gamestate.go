@@ -1,13 +1,19 @@
 package gamelogic
 
 import (
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
+// GameState is a player's view of the game. It only changes by recording
+// events, and Player and Paused always equal the replay of Events.
 type GameState struct {
 	Player Player
 	Paused bool
 	mu     *sync.RWMutex
+	events []RecordedEvent
 }
 
 func NewGameState(username string) *GameState {
@@ -21,19 +27,66 @@ func NewGameState(username string) *GameState {
 	}
 }
 
+// NewGameStateFromEvents rebuilds a GameState from its recorded history.
+func NewGameStateFromEvents(username string, events []RecordedEvent) *GameState {
+	gs := NewGameState(username)
+	gs.events = append([]RecordedEvent{}, events...)
+	gs.setState(Replay(username, events))
+	return gs
+}
+
+// record appends e to the history and applies it. Callers must hold gs.mu.
+func (gs *GameState) record(e Event) {
+	gs.events = append(gs.events, RecordedEvent{
+		Seq:   len(gs.events) + 1,
+		At:    time.Now(),
+		Event: e,
+	})
+	gs.setState(Apply(gs.state(), e))
+}
+
+// state returns the current State. Callers must hold gs.mu.
+func (gs *GameState) state() State {
+	return State{Username: gs.Player.Username, Units: gs.Player.Units, Paused: gs.Paused}
+}
+
+// setState replaces the current state. Callers must hold gs.mu.
+func (gs *GameState) setState(s State) {
+	gs.Player.Units = s.Units
+	gs.Paused = s.Paused
+}
+
+// Events returns the history of the game state, oldest first.
+func (gs *GameState) Events() []RecordedEvent {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	return append([]RecordedEvent{}, gs.events...)
+}
+
+// StateAt returns the state right after the event with sequence number seq,
+// or the initial state for 0.
+func (gs *GameState) StateAt(seq int) (State, error) {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	if seq < 0 || seq > len(gs.events) {
+		return State{}, fmt.Errorf("no event #%d, the last one is #%d", seq, len(gs.events))
+	}
+	return Replay(gs.Player.Username, gs.events[:seq]), nil
+}
+
 func (gs *GameState) resumeGame() {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
-	gs.Paused = false
+	gs.record(GameResumed{})
 }
 
 func (gs *GameState) pauseGame() {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
-	gs.Paused = true
+	gs.record(GamePaused{})
 }
 
-func (gs *GameState) isPaused() bool {
+func (gs *GameState) IsPaused() bool {
 	gs.mu.RLock()
 	defer gs.mu.RUnlock()
 	return gs.Paused
@@ -42,23 +95,80 @@ func (gs *GameState) isPaused() bool {
 func (gs *GameState) addUnit(u Unit) {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
-	gs.Player.Units[u.ID] = u
+	gs.record(UnitSpawned{Unit: u})
 }
 
-func (gs *GameState) removeUnitsInLocation(loc Location) {
+// removeUnits removes the units with ids, which were killed in loc.
+func (gs *GameState) removeUnits(loc Location, ids []int) {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
-	for k, v := range gs.Player.Units {
-		if v.Location == loc {
-			delete(gs.Player.Units, k)
-		}
+	gs.record(UnitsDestroyed{Location: loc, UnitIDs: ids})
+}
+
+// replaceUnits overwrites the player's units, for example with the server's
+// view of them.
+func (gs *GameState) replaceUnits(units map[int]Unit) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	synced := make([]Unit, 0, len(units))
+	for _, unit := range units {
+		synced = append(synced, unit)
 	}
+	sort.Slice(synced, func(i, j int) bool { return synced[i].ID < synced[j].ID })
+	gs.record(UnitsSynced{Units: synced})
 }
 
+// UpdateUnit moves a known unit to u.Location.
 func (gs *GameState) UpdateUnit(u Unit) {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
-	gs.Player.Units[u.ID] = u
+	gs.record(UnitMoved{UnitID: u.ID, From: gs.Player.Units[u.ID].Location, To: u.Location})
+}
+
+func (gs *GameState) departUnits(ids []int, to Location, arrivesAt Tick) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	for _, id := range ids {
+		gs.record(UnitDeparted{UnitID: id, To: to, ArrivesAt: arrivesAt})
+	}
+}
+
+// adoptArrivals takes the server's arrival tick for our units travelling to
+// the same destination as they are in units.
+func (gs *GameState) adoptArrivals(units map[int]Unit) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	ids := make([]int, 0, len(units))
+	for id := range units {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		theirs, ours := units[id], gs.Player.Units[id]
+		if ours.InTransit() && theirs.Destination == ours.Destination && theirs.ArrivesAt != ours.ArrivesAt {
+			gs.record(UnitDeparted{UnitID: id, To: ours.Destination, ArrivesAt: theirs.ArrivesAt})
+		}
+	}
+}
+
+// arriveUnits lands every unit due by now and returns them, sorted by ID.
+func (gs *GameState) arriveUnits(now Tick) []Unit {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	ids := []int{}
+	for id, unit := range gs.Player.Units {
+		if unit.InTransit() && unit.ArrivesAt <= now {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	arrived := []Unit{}
+	for _, id := range ids {
+		gs.record(UnitArrived{UnitID: id})
+		arrived = append(arrived, gs.Player.Units[id])
+	}
+	return arrived
 }
 
 func (gs *GameState) GetUsername() string {
@@ -0,0 +1,481 @@
+package gamelogic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Ledger is the server's authoritative record of every player's units.
+// Clients report their spawns and moves, and the ledger only accepts the ones
+// that agree with what it already knows, so editing a client's local state
+// gains nothing.
+type Ledger struct {
+	mu      sync.Mutex
+	path    string
+	players map[string]map[int]Unit
+	spent   map[string]int
+	entries map[string]map[int]unitEntry
+	// spawned is closed and replaced whenever a unit spawns.
+	spawned chan struct{}
+}
+
+// unitEntry is when a unit last spawned or arrived in its location, and
+// whether the ledger has fought over it since. A redelivered arrival finds
+// its entry fought, so it doesn't fight again.
+type unitEntry struct {
+	At     Tick
+	Fought bool
+}
+
+// ErrLedgerNotSaved wraps the errors of changes the ledger applied but could
+// not write to its file. Applying them again is safe.
+var ErrLedgerNotSaved = errors.New("could not save the ledger")
+
+// UnknownUnitError rejects a move of a unit the ledger hasn't heard of, which
+// may be because its spawn is still on the way.
+type UnknownUnitError struct {
+	ID int
+}
+
+func (e UnknownUnitError) Error() string {
+	return fmt.Sprintf("unit %d does not exist", e.ID)
+}
+
+// NewLedger returns an empty ledger that is only kept in memory.
+func NewLedger() *Ledger {
+	return &Ledger{
+		players: map[string]map[int]Unit{},
+		spent:   map[string]int{},
+		entries: map[string]map[int]unitEntry{},
+		spawned: make(chan struct{}),
+	}
+}
+
+// ledgerFile is what OpenLedger reads and every change writes.
+type ledgerFile struct {
+	Players map[string]map[int]Unit
+	Spent   map[string]int
+	Entries map[string]map[int]unitEntry
+}
+
+// OpenLedger returns the ledger saved at path, or an empty one when the file
+// doesn't exist yet. Every accepted change is written back to path before it
+// is reported, so a restarted server knows every unit it accepted.
+func OpenLedger(path string) (*Ledger, error) {
+	l := NewLedger()
+	l.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read ledger: %v", err)
+	}
+
+	var file ledgerFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse ledger %s: %v", path, err)
+	}
+	for username, units := range file.Players {
+		if units == nil {
+			units = map[int]Unit{}
+		}
+		l.players[username] = units
+	}
+	for username, spent := range file.Spent {
+		l.spent[username] = spent
+	}
+	for username, entries := range file.Entries {
+		l.entries[username] = entries
+	}
+	return l, nil
+}
+
+// save replaces the ledger's file in one step, like GameState.Save. Callers
+// must hold l.mu.
+func (l *Ledger) save() error {
+	if l.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(ledgerFile{Players: l.players, Spent: l.spent, Entries: l.entries}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLedgerNotSaved, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".*")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLedgerNotSaved, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLedgerNotSaved, err)
+	}
+	return nil
+}
+
+// Spawned returns a channel that is closed the next time a unit spawns.
+func (l *Ledger) Spawned() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.spawned
+}
+
+func (l *Ledger) Spawn(sp ArmySpawn) error {
+	if !currentMap().Has(sp.Unit.Location) {
+		return fmt.Errorf("%s is not a valid location", sp.Unit.Location)
+	}
+	if sp.Unit.InTransit() {
+		return fmt.Errorf("unit %d can't spawn on the move", sp.Unit.ID)
+	}
+	rule, ok := rankRule(sp.Unit.Rank)
+	if !ok {
+		return fmt.Errorf("%s is not a valid unit", sp.Unit.Rank)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	units, ok := l.players[sp.Username]
+	if !ok {
+		units = map[int]Unit{}
+		l.players[sp.Username] = units
+	}
+	if existing, ok := units[sp.Unit.ID]; ok {
+		// A redelivered spawn is fine, a second unit with the same ID isn't.
+		// It may be redelivered because it wasn't saved.
+		if existing == sp.Unit {
+			return l.save()
+		}
+		return fmt.Errorf("unit %d already exists", sp.Unit.ID)
+	}
+
+	rules, _ := ActiveRuleset()
+	if rules.Budget > 0 && l.spent[sp.Username]+rule.Cost > rules.Budget {
+		return fmt.Errorf("a(n) %s costs %d, only %d of the budget is left", sp.Unit.Rank, rule.Cost, rules.Budget-l.spent[sp.Username])
+	}
+	l.spent[sp.Username] += rule.Cost
+
+	units[sp.Unit.ID] = sp.Unit
+	l.enter(sp.Username, sp.Unit.ID, CurrentTick())
+	close(l.spawned)
+	l.spawned = make(chan struct{})
+	return l.save()
+}
+
+// clockSkew is how far ahead of the server's clock a client's may be.
+const clockSkew Tick = 2
+
+// Move applies a departure or an arrival once every unit in mv exists,
+// belongs to the mover and has the rank the mover claims. Departing units
+// must stand together in a location with a route to mv.ToLocation, and
+// arrive when the route's ticks after the ledger heard of the move are up,
+// so a client can't shorten a journey by claiming it set off earlier;
+// arriving units must have reached the end of their journey, give or take
+// clockSkew. Redelivered moves are accepted again.
+func (l *Ledger) Move(mv ArmyMove) error {
+	if !currentMap().Has(mv.ToLocation) {
+		return fmt.Errorf("%s is not a valid location", mv.ToLocation)
+	}
+	if len(mv.Units) == 0 {
+		return errors.New("no units were moved")
+	}
+	now := CurrentTick()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	units := l.players[mv.Player.Username]
+	ids := []int{}
+	seen := map[int]bool{}
+	for _, unit := range mv.Units {
+		known, ok := units[unit.ID]
+		if !ok {
+			return UnknownUnitError{ID: unit.ID}
+		}
+		if known.Rank != unit.Rank {
+			return fmt.Errorf("unit %d is %s, not %s", unit.ID, known.Rank, unit.Rank)
+		}
+		if seen[unit.ID] {
+			return fmt.Errorf("unit %d is moved twice", unit.ID)
+		}
+		seen[unit.ID] = true
+		ids = append(ids, unit.ID)
+	}
+
+	if !mv.Arrived {
+		err := depart(units, ids, mv.ToLocation, mv.DepartedAt, now)
+		if err != nil {
+			return err
+		}
+		return l.save()
+	}
+
+	// Units already there arrived before, and keep that entry.
+	arriving := map[int]Tick{}
+	for _, id := range ids {
+		if unit := units[id]; !unit.At(mv.ToLocation) {
+			arriving[id] = unit.ArrivesAt
+		}
+	}
+	err := arrive(units, ids, mv.ToLocation, now)
+	if err != nil {
+		return err
+	}
+	for id, at := range arriving {
+		l.enter(mv.Player.Username, id, at)
+	}
+	return l.save()
+}
+
+// enter records that a unit entered its location at a tick, and hasn't been
+// fought over there yet. Callers must hold l.mu.
+func (l *Ledger) enter(username string, id int, at Tick) {
+	if l.entries[username] == nil {
+		l.entries[username] = map[int]unitEntry{}
+	}
+	l.entries[username][id] = unitEntry{At: at}
+}
+
+func depart(units map[int]Unit, ids []int, to Location, departedAt, now Tick) error {
+	var from Location
+	for _, id := range ids {
+		unit := units[id]
+		if unit.InTransit() {
+			if unit.Destination == to {
+				continue
+			}
+			return fmt.Errorf("unit %d is on its way to %s", id, unit.Destination)
+		}
+		if from != "" && unit.Location != from {
+			return errors.New("units moving together must start in the same location")
+		}
+		from = unit.Location
+	}
+	if from == "" {
+		return nil
+	}
+	if from == to {
+		return fmt.Errorf("the units are already in %s", to)
+	}
+	if departedAt > now+clockSkew {
+		return fmt.Errorf("the units can't set off at tick %d, it is only tick %d", departedAt, now)
+	}
+
+	route, err := currentMap().Route(from, to)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		unit := units[id]
+		if !unit.InTransit() {
+			unit.Destination = to
+			unit.ArrivesAt = now + Tick(route.Ticks)
+			units[id] = unit
+		}
+	}
+	return nil
+}
+
+func arrive(units map[int]Unit, ids []int, to Location, now Tick) error {
+	for _, id := range ids {
+		unit := units[id]
+		if unit.At(to) {
+			continue
+		}
+		if unit.Destination != to {
+			return fmt.Errorf("unit %d is not on its way to %s", id, to)
+		}
+		if unit.ArrivesAt > now+clockSkew {
+			return fmt.Errorf("unit %d only arrives at tick %d", id, unit.ArrivesAt)
+		}
+	}
+
+	for _, id := range ids {
+		unit := units[id]
+		unit.Location = to
+		unit.Destination = ""
+		unit.ArrivesAt = 0
+		units[id] = unit
+	}
+	return nil
+}
+
+// Battles fights over loc once username's units ids spawned or arrived
+// there, where username attacks and everyone else in loc defends. Fights
+// elsewhere are left to the units entering there. The casualties are
+// removed, and the units' entry is remembered, so a redelivered spawn or
+// arrival fights nothing. There is at most one result, none when loc isn't
+// contested. An error means the battle was fought but not saved.
+func (l *Ledger) Battles(username string, ids []int, loc Location) ([]BattleResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fresh := false
+	for _, id := range ids {
+		unit, ok := l.players[username][id]
+		if !ok || !unit.At(loc) {
+			continue
+		}
+		entry, ok := l.entries[username][id]
+		if ok && entry.Fought {
+			continue
+		}
+		if !ok {
+			l.enter(username, id, 0)
+		}
+		entry = l.entries[username][id]
+		entry.Fought = true
+		l.entries[username][id] = entry
+		fresh = true
+	}
+	if !fresh {
+		return nil, nil
+	}
+
+	players := make([]Player, 0, len(l.players))
+	for username := range l.players {
+		players = append(players, l.player(username))
+	}
+	b := NewBattle(loc, username, players)
+	if len(b.Sides) < 2 {
+		return nil, l.save()
+	}
+
+	result := ActiveResolver().Resolve(b)
+	for username, ids := range result.Casualties {
+		for _, id := range ids {
+			delete(l.players[username], id)
+			delete(l.entries[username], id)
+		}
+	}
+	return []BattleResult{result}, l.save()
+}
+
+func (l *Ledger) Player(username string) Player {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.player(username)
+}
+
+// Lookup is Player, and also reports whether the ledger has ever heard of
+// the player.
+func (l *Ledger) Lookup(username string) (Player, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.players[username]
+	return l.player(username), ok
+}
+
+// Winner returns the player, or the alliance, who met the ruleset's victory
+// conditions, or "" while nobody has.
+func (l *Ledger) Winner() string {
+	rules, _ := ActiveRuleset()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	usernames := make([]string, 0, len(l.players))
+	for username := range l.players {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	occupants := map[Location]map[sideKey]bool{}
+	alive := map[sideKey]bool{}
+	sides := []sideKey{}
+	for _, username := range usernames {
+		side := sideOf(username)
+		if !slices.Contains(sides, side) {
+			sides = append(sides, side)
+		}
+		for _, unit := range l.players[username] {
+			if unit.InTransit() {
+				continue
+			}
+			if occupants[unit.Location] == nil {
+				occupants[unit.Location] = map[sideKey]bool{}
+			}
+			occupants[unit.Location][side] = true
+		}
+		if len(l.players[username]) > 0 {
+			alive[side] = true
+		}
+	}
+
+	if rules.Victory.HoldLocations > 0 {
+		alone := map[sideKey]int{}
+		for _, held := range occupants {
+			if len(held) == 1 {
+				for side := range held {
+					alone[side]++
+				}
+			}
+		}
+		for _, side := range sides {
+			if alone[side] >= rules.Victory.HoldLocations {
+				return side.name
+			}
+		}
+	}
+
+	if rules.Victory.LastStanding && len(sides) >= 2 && len(alive) == 1 {
+		for side := range alive {
+			return side.name
+		}
+	}
+	return ""
+}
+
+// Players returns every player the ledger knows, sorted by username.
+func (l *Ledger) Players() []Player {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	players := make([]Player, 0, len(l.players))
+	for username := range l.players {
+		players = append(players, l.player(username))
+	}
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].Username < players[j].Username
+	})
+	return players
+}
+
+// player returns a copy of a player's units. Callers must hold l.mu.
+func (l *Ledger) player(username string) Player {
+	units := map[int]Unit{}
+	for id, unit := range l.players[username] {
+		units[id] = unit
+	}
+	return Player{Username: username, Units: units}
+}
+
+func unitsIn(p Player, loc Location) []Unit {
+	units := []Unit{}
+	for _, unit := range p.Units {
+		if unit.At(loc) {
+			units = append(units, unit)
+		}
+	}
+	return units
+}
@@ -0,0 +1,395 @@
+package gamelogic
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// ledgerWith returns a ledger in memory holding units for alice.
+func ledgerWith(units ...Unit) *Ledger {
+	l := NewLedger()
+	l.players["alice"] = map[int]Unit{}
+	for _, unit := range units {
+		l.players["alice"][unit.ID] = unit
+	}
+	return l
+}
+
+func TestLedgerMove(t *testing.T) {
+	now := CurrentTick()
+	alice := Player{Username: "alice"}
+	infantry := func(id int, loc Location) Unit {
+		return Unit{ID: id, Rank: RankInfantry, Location: loc}
+	}
+	travelling := func(id int, from, to Location, arrivesAt Tick) Unit {
+		return Unit{ID: id, Rank: RankInfantry, Location: from, Destination: to, ArrivesAt: arrivesAt}
+	}
+
+	tests := []struct {
+		name    string
+		units   []Unit
+		move    ArmyMove
+		wantErr string
+		want    []Unit
+	}{
+		{
+			name:  "departs along the fastest route",
+			units: []Unit{infantry(1, "americas"), infantry(2, "americas")},
+			move:  ArmyMove{Player: alice, ToLocation: "asia", DepartedAt: now, Units: []Unit{infantry(1, "americas"), infantry(2, "americas")}},
+			want:  []Unit{travelling(1, "americas", "asia", now+4), travelling(2, "americas", "asia", now+4)},
+		},
+		{
+			// The journey is timed from when the ledger hears of it.
+			name:  "backdated departure",
+			units: []Unit{infantry(1, "americas")},
+			move:  ArmyMove{Player: alice, ToLocation: "asia", DepartedAt: now - 30, Units: []Unit{infantry(1, "americas")}},
+			want:  []Unit{travelling(1, "americas", "asia", now+4)},
+		},
+		{
+			name:  "departure from a clock slightly ahead",
+			units: []Unit{infantry(1, "americas")},
+			move:  ArmyMove{Player: alice, ToLocation: "asia", DepartedAt: now + 1, Units: []Unit{infantry(1, "americas")}},
+			want:  []Unit{travelling(1, "americas", "asia", now+4)},
+		},
+		{
+			name:    "departure in the future",
+			units:   []Unit{infantry(1, "americas")},
+			move:    ArmyMove{Player: alice, ToLocation: "asia", DepartedAt: now + 100, Units: []Unit{infantry(1, "americas")}},
+			wantErr: "can't set off at tick",
+		},
+		{
+			name:  "departure redelivered",
+			units: []Unit{travelling(1, "europe", "asia", now+1)},
+			move:  ArmyMove{Player: alice, ToLocation: "asia", DepartedAt: now, Units: []Unit{infantry(1, "europe")}},
+			want:  []Unit{travelling(1, "europe", "asia", now+1)},
+		},
+		{
+			name:    "unknown unit",
+			units:   []Unit{infantry(1, "europe")},
+			move:    ArmyMove{Player: alice, ToLocation: "asia", DepartedAt: now, Units: []Unit{infantry(2, "europe")}},
+			wantErr: "unit 2 does not exist",
+		},
+		{
+			name:    "another player's unit",
+			units:   []Unit{infantry(1, "europe")},
+			move:    ArmyMove{Player: Player{Username: "bob"}, ToLocation: "asia", DepartedAt: now, Units: []Unit{infantry(1, "europe")}},
+			wantErr: "unit 1 does not exist",
+		},
+		{
+			name:    "wrong rank",
+			units:   []Unit{infantry(1, "europe")},
+			move:    ArmyMove{Player: alice, ToLocation: "asia", DepartedAt: now, Units: []Unit{{ID: 1, Rank: RankArtillery, Location: "europe"}}},
+			wantErr: "unit 1 is infantry, not artillery",
+		},
+		{
+			name:    "unit moved twice",
+			units:   []Unit{infantry(1, "europe")},
+			move:    ArmyMove{Player: alice, ToLocation: "asia", DepartedAt: now, Units: []Unit{infantry(1, "europe"), infantry(1, "europe")}},
+			wantErr: "unit 1 is moved twice",
+		},
+		{
+			name:    "no units",
+			move:    ArmyMove{Player: alice, ToLocation: "asia"},
+			wantErr: "no units were moved",
+		},
+		{
+			name:    "invalid location",
+			units:   []Unit{infantry(1, "europe")},
+			move:    ArmyMove{Player: alice, ToLocation: "atlantis", DepartedAt: now, Units: []Unit{infantry(1, "europe")}},
+			wantErr: "atlantis is not a valid location",
+		},
+		{
+			name:    "units apart",
+			units:   []Unit{infantry(1, "europe"), infantry(2, "africa")},
+			move:    ArmyMove{Player: alice, ToLocation: "asia", DepartedAt: now, Units: []Unit{infantry(1, "europe"), infantry(2, "africa")}},
+			wantErr: "units moving together must start in the same location",
+		},
+		{
+			name:    "already there",
+			units:   []Unit{infantry(1, "asia")},
+			move:    ArmyMove{Player: alice, ToLocation: "asia", DepartedAt: now, Units: []Unit{infantry(1, "asia")}},
+			wantErr: "the units are already in asia",
+		},
+		{
+			name:    "on its way elsewhere",
+			units:   []Unit{travelling(1, "europe", "africa", now+1)},
+			move:    ArmyMove{Player: alice, ToLocation: "asia", DepartedAt: now, Units: []Unit{infantry(1, "europe")}},
+			wantErr: "unit 1 is on its way to africa",
+		},
+		{
+			name:  "arrives",
+			units: []Unit{travelling(1, "europe", "asia", now-1)},
+			move:  ArmyMove{Player: alice, ToLocation: "asia", Arrived: true, Units: []Unit{infantry(1, "asia")}},
+			want:  []Unit{infantry(1, "asia")},
+		},
+		{
+			name:  "arrives by a clock slightly ahead",
+			units: []Unit{travelling(1, "europe", "asia", now+1)},
+			move:  ArmyMove{Player: alice, ToLocation: "asia", Arrived: true, Units: []Unit{infantry(1, "asia")}},
+			want:  []Unit{infantry(1, "asia")},
+		},
+		{
+			name:  "arrival redelivered",
+			units: []Unit{infantry(1, "asia")},
+			move:  ArmyMove{Player: alice, ToLocation: "asia", Arrived: true, Units: []Unit{infantry(1, "asia")}},
+			want:  []Unit{infantry(1, "asia")},
+		},
+		{
+			name:    "arrives early",
+			units:   []Unit{travelling(1, "americas", "asia", now+100)},
+			move:    ArmyMove{Player: alice, ToLocation: "asia", Arrived: true, Units: []Unit{infantry(1, "asia")}},
+			wantErr: "only arrives at tick",
+		},
+		{
+			name:    "arrives somewhere else",
+			units:   []Unit{travelling(1, "europe", "africa", now-1)},
+			move:    ArmyMove{Player: alice, ToLocation: "asia", Arrived: true, Units: []Unit{infantry(1, "asia")}},
+			wantErr: "unit 1 is not on its way to asia",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := ledgerWith(tt.units...)
+			err := l.Move(tt.move)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Move returned %v, want an error containing %q", err, tt.wantErr)
+				}
+				// A rejected move changes nothing.
+				for _, unit := range tt.units {
+					if got := l.players["alice"][unit.ID]; got != unit {
+						t.Errorf("unit %d is %+v after a rejected move, want %+v", unit.ID, got, unit)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Move returned %v", err)
+			}
+
+			got := l.Player("alice").Units
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d units, want %d", len(got), len(tt.want))
+			}
+			for _, want := range tt.want {
+				if unit := got[want.ID]; unit != want {
+					t.Errorf("unit %d is %+v, want %+v", want.ID, unit, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLedgerMoveOfUnknownUnit(t *testing.T) {
+	l := NewLedger()
+	spawned := l.Spawned()
+
+	mv := ArmyMove{Player: Player{Username: "alice"}, ToLocation: "asia", DepartedAt: CurrentTick(), Units: []Unit{{ID: 1, Rank: RankInfantry, Location: "europe"}}}
+	err := l.Move(mv)
+	var unknown UnknownUnitError
+	if !errors.As(err, &unknown) || unknown.ID != 1 {
+		t.Fatalf("Move returned %v, want UnknownUnitError for unit 1", err)
+	}
+
+	err = l.Spawn(ArmySpawn{Username: "alice", Unit: Unit{ID: 1, Rank: RankInfantry, Location: "europe"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-spawned:
+	default:
+		t.Fatal("Spawned wasn't closed by the spawn")
+	}
+
+	if err := l.Move(mv); err != nil {
+		t.Errorf("Move after the spawn returned %v", err)
+	}
+}
+
+func TestOpenLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+
+	l, err := OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Players()) != 0 {
+		t.Fatalf("a new ledger has players: %v", l.Players())
+	}
+
+	unit := Unit{ID: 1, Rank: RankInfantry, Location: "europe"}
+	err = l.Spawn(ArmySpawn{Username: "alice", Unit: unit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Move(ArmyMove{Player: Player{Username: "alice"}, ToLocation: "asia", DepartedAt: CurrentTick(), Units: []Unit{unit}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := l.Player("alice").Units[1]
+
+	reopened, err := OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.Player("alice").Units[1]; got != want {
+		t.Errorf("reopened ledger has %+v, want %+v", got, want)
+	}
+	if got := reopened.entries["alice"][1]; got != l.entries["alice"][1] {
+		t.Errorf("reopened ledger has entry %+v, want %+v", got, l.entries["alice"][1])
+	}
+	rule, _ := rankRule(RankInfantry)
+	if reopened.spent["alice"] != rule.Cost {
+		t.Errorf("reopened ledger spent %d, want %d", reopened.spent["alice"], rule.Cost)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLedger(path); err == nil {
+		t.Error("OpenLedger accepted a corrupt file")
+	}
+}
+
+func TestLedgerBattles(t *testing.T) {
+	unit := func(id int, rank UnitRank, loc Location) Unit {
+		return Unit{ID: id, Rank: rank, Location: loc}
+	}
+
+	tests := []struct {
+		name    string
+		players map[string][]Unit
+		// fought marks alice's units whose entry was already fought over.
+		fought []int
+		ids    []int
+		loc    Location
+		// want is the locations fought over, in order, and the units left.
+		want []Location
+		left map[string][]int
+	}{
+		{
+			name:    "arrival among enemies",
+			players: map[string][]Unit{"alice": {unit(1, RankCavalry, "asia")}, "bob": {unit(1, RankInfantry, "asia")}},
+			ids:     []int{1},
+			loc:     "asia",
+			want:    []Location{"asia"},
+			left:    map[string][]int{"alice": {1}, "bob": {}},
+		},
+		{
+			name:    "redelivered arrival",
+			players: map[string][]Unit{"alice": {unit(1, RankCavalry, "asia")}, "bob": {unit(1, RankInfantry, "asia")}},
+			fought:  []int{1},
+			ids:     []int{1},
+			loc:     "asia",
+			left:    map[string][]int{"alice": {1}, "bob": {1}},
+		},
+		{
+			name:    "no enemies",
+			players: map[string][]Unit{"alice": {unit(1, RankCavalry, "asia")}, "bob": {unit(1, RankInfantry, "europe")}},
+			ids:     []int{1},
+			loc:     "asia",
+			left:    map[string][]int{"alice": {1}, "bob": {1}},
+		},
+		{
+			name: "only where the units entered",
+			players: map[string][]Unit{
+				"alice": {unit(1, RankCavalry, "asia"), unit(2, RankArtillery, "africa")},
+				"bob":   {unit(1, RankInfantry, "asia"), unit(2, RankInfantry, "africa"), unit(3, RankInfantry, "europe")},
+			},
+			ids:  []int{1},
+			loc:  "asia",
+			want: []Location{"asia"},
+			left: map[string][]int{"alice": {1, 2}, "bob": {2, 3}},
+		},
+		{
+			name:    "units elsewhere",
+			players: map[string][]Unit{"alice": {unit(1, RankCavalry, "europe")}, "bob": {unit(1, RankInfantry, "asia")}},
+			ids:     []int{1},
+			loc:     "asia",
+			left:    map[string][]int{"alice": {1}, "bob": {1}},
+		},
+		{
+			name:    "dead units don't fight",
+			players: map[string][]Unit{"alice": {unit(1, RankCavalry, "asia")}, "bob": {unit(1, RankInfantry, "asia")}},
+			ids:     []int{9},
+			loc:     "asia",
+			left:    map[string][]int{"alice": {1}, "bob": {1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLedger()
+			for username, units := range tt.players {
+				l.players[username] = map[int]Unit{}
+				for _, unit := range units {
+					l.players[username][unit.ID] = unit
+				}
+			}
+			l.entries["alice"] = map[int]unitEntry{}
+			for _, id := range tt.fought {
+				l.entries["alice"][id] = unitEntry{At: 10, Fought: true}
+			}
+
+			results, err := l.Battles("alice", tt.ids, tt.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []Location{}
+			for _, result := range results {
+				got = append(got, result.Location)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("fought over %v, want %v", got, tt.want)
+			}
+			for username, want := range tt.left {
+				ids := []int{}
+				for id := range l.Player(username).Units {
+					ids = append(ids, id)
+				}
+				slices.Sort(ids)
+				if !slices.Equal(ids, want) {
+					t.Errorf("%s has units %v, want %v", username, ids, want)
+				}
+			}
+
+			// Fighting again over the same entry does nothing.
+			again, err := l.Battles("alice", tt.ids, tt.loc)
+			if err != nil || len(again) != 0 {
+				t.Errorf("second Battles fought %d battles, error %v", len(again), err)
+			}
+		})
+	}
+}
+
+func TestLedgerArrivalEntersLocation(t *testing.T) {
+	now := CurrentTick()
+	l := ledgerWith(Unit{ID: 1, Rank: RankCavalry, Location: "europe", Destination: "asia", ArrivesAt: now - 1})
+	l.players["bob"] = map[int]Unit{1: {ID: 1, Rank: RankInfantry, Location: "asia"}}
+	arrival := ArmyMove{Player: Player{Username: "alice"}, ToLocation: "asia", Arrived: true, Units: []Unit{{ID: 1, Rank: RankCavalry, Location: "asia"}}}
+
+	if err := l.Move(arrival); err != nil {
+		t.Fatal(err)
+	}
+	if entry := l.entries["alice"][1]; entry != (unitEntry{At: now - 1}) {
+		t.Fatalf("entry %+v after the arrival, want one at tick %d", entry, now-1)
+	}
+	results, err := l.Battles("alice", []int{1}, "asia")
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Battles fought %d battles, error %v", len(results), err)
+	}
+
+	// The arrival is redelivered after the battle.
+	if err := l.Move(arrival); err != nil {
+		t.Fatal(err)
+	}
+	if results, _ := l.Battles("alice", []int{1}, "asia"); len(results) != 0 {
+		t.Errorf("a redelivered arrival fought %d battles", len(results))
+	}
+}
@@ -4,29 +4,102 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 )
 
-const logsFile = "game.log"
+var (
+	logsFile = "game.log"
+	// logsMu keeps WriteLog from appending to a logs file RebuildLog is
+	// about to replace.
+	logsMu sync.Mutex
+	// rebuilt holds the IDs of the logs the last rebuild wrote, which
+	// WriteLog skips when they arrive live as well.
+	rebuilt = map[string]bool{}
+)
+
+// SetLogsFile changes where WriteLog and RebuildLog write, game.log by
+// default.
+func SetLogsFile(path string) {
+	logsFile = path
+}
 
 const writeToDiskSleep = 1 * time.Second
 
-func WriteLog(gamelog routing.GameLog) error {
+// WriteLog appends a game log to the logs file. id tells it apart from the
+// logs a rebuild already wrote; logs without one are always written.
+func WriteLog(id string, gamelog routing.GameLog) error {
 	log.Printf("received game log...")
 	time.Sleep(writeToDiskSleep)
 
+	logsMu.Lock()
+	defer logsMu.Unlock()
+
+	if id != "" && rebuilt[id] {
+		return nil
+	}
+
 	f, err := os.OpenFile(logsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("could not open logs file: %v", err)
 	}
 	defer f.Close()
 
-	str := fmt.Sprintf("%v %v: %v\n", gamelog.CurrentTime.Format(time.RFC3339), gamelog.Username, gamelog.Message)
-	_, err = f.WriteString(str)
+	_, err = f.WriteString(formatLog(gamelog))
+	if err != nil {
+		return fmt.Errorf("could not write to logs file: %v", err)
+	}
+	return nil
+}
+
+// RebuildLog replaces the logs file with every log replay writes, for
+// example by replaying the game log stream from the start up to its current
+// end. WriteLog waits until the rebuild is done, so logs received meanwhile
+// are appended to the rebuilt file rather than lost with the old one, unless
+// the rebuild wrote a log with the same id already.
+func RebuildLog(replay func(write func(id string, gamelog routing.GameLog) error) error) error {
+	logsMu.Lock()
+	defer logsMu.Unlock()
+
+	tmp := logsFile + ".rebuild"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("could not create logs file: %v", err)
+	}
+
+	ids := map[string]bool{}
+	err = replay(func(id string, gamelog routing.GameLog) error {
+		_, err := f.WriteString(formatLog(gamelog))
+		if err != nil {
+			return fmt.Errorf("could not write to logs file: %v", err)
+		}
+		if id != "" {
+			ids[id] = true
+		}
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	err = f.Close()
 	if err != nil {
+		os.Remove(tmp)
 		return fmt.Errorf("could not write to logs file: %v", err)
 	}
+
+	err = os.Rename(tmp, logsFile)
+	if err != nil {
+		return err
+	}
+	rebuilt = ids
 	return nil
 }
+
+func formatLog(gamelog routing.GameLog) string {
+	return fmt.Sprintf("%v %v: %v\n", gamelog.CurrentTime.Format(time.RFC3339), gamelog.Username, gamelog.Message)
+}
@@ -0,0 +1,98 @@
+package gamelogic
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestRebuildLog(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	replayed := []routing.GameLog{
+		{CurrentTime: at, Username: "alice", Message: "first"},
+		{CurrentTime: at.Add(time.Second), Username: "bob", Message: "second"},
+	}
+	want := "2024-05-01T12:00:00Z alice: first\n2024-05-01T12:00:01Z bob: second\n"
+
+	tests := []struct {
+		name      string
+		replayErr error
+		wantFile  string
+	}{
+		{name: "replaces the file", wantFile: want},
+		{name: "keeps the old file on error", replayErr: errors.New("stream closed"), wantFile: "old\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "game.log")
+			if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			SetLogsFile(path)
+			t.Cleanup(func() { SetLogsFile("game.log") })
+
+			err := RebuildLog(func(write func(string, routing.GameLog) error) error {
+				for i, gl := range replayed {
+					if err := write(strconv.Itoa(i), gl); err != nil {
+						return err
+					}
+				}
+				return tt.replayErr
+			})
+			if !errors.Is(err, tt.replayErr) {
+				t.Fatalf("RebuildLog() error = %v, want %v", err, tt.replayErr)
+			}
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.wantFile {
+				t.Errorf("logs file = %q, want %q", got, tt.wantFile)
+			}
+			if _, err := os.Stat(path + ".rebuild"); !os.IsNotExist(err) {
+				t.Errorf("temporary file left behind: %v", err)
+			}
+		})
+	}
+}
+
+// Logs the rebuild replayed may still be waiting in the live queue, and must
+// not be written twice.
+func TestWriteLogAfterRebuild(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.log")
+	SetLogsFile(path)
+	t.Cleanup(func() { SetLogsFile("game.log") })
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	replayed := routing.GameLog{CurrentTime: at, Username: "alice", Message: "replayed"}
+	live := routing.GameLog{CurrentTime: at.Add(time.Second), Username: "bob", Message: "live"}
+
+	err := RebuildLog(func(write func(string, routing.GameLog) error) error {
+		return write("a", replayed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteLog("a", replayed); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteLog("b", live); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2024-05-01T12:00:00Z alice: replayed\n2024-05-01T12:00:01Z bob: live\n"
+	if string(got) != want {
+		t.Errorf("logs file = %q, want %q", got, want)
+	}
+}
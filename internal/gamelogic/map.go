@@ -0,0 +1,132 @@
+package gamelogic
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Tick is the game clock: the number of TickDuration intervals since the Unix
+// epoch. Clients and the server each read it from their own clock.
+type Tick int64
+
+const TickDuration = time.Second
+
+func TickAt(t time.Time) Tick {
+	return Tick(t.UnixMilli() / TickDuration.Milliseconds())
+}
+
+func CurrentTick() Tick {
+	return TickAt(time.Now())
+}
+
+// Map is the board: its locations and the routes between them, each taking
+// a number of ticks to travel in either direction.
+type Map struct {
+	edges map[Location]map[Location]int
+}
+
+func NewMap() *Map {
+	return &Map{edges: map[Location]map[Location]int{}}
+}
+
+// AddLocation adds loc, unconnected, if the map doesn't have it yet.
+func (m *Map) AddLocation(loc Location) {
+	if _, ok := m.edges[loc]; !ok {
+		m.edges[loc] = map[Location]int{}
+	}
+}
+
+// Connect adds a route between a and b taking ticks, which must be positive,
+// adding the locations if needed.
+func (m *Map) Connect(a, b Location, ticks int) {
+	m.AddLocation(a)
+	m.AddLocation(b)
+	m.edges[a][b] = ticks
+	m.edges[b][a] = ticks
+}
+
+func (m *Map) Has(loc Location) bool {
+	_, ok := m.edges[loc]
+	return ok
+}
+
+// Locations returns every location, sorted.
+func (m *Map) Locations() []Location {
+	locs := make([]Location, 0, len(m.edges))
+	for loc := range m.edges {
+		locs = append(locs, loc)
+	}
+	sort.Slice(locs, func(i, j int) bool { return locs[i] < locs[j] })
+	return locs
+}
+
+// Neighbors returns the locations one route away from loc, sorted.
+func (m *Map) Neighbors(loc Location) []Location {
+	locs := make([]Location, 0, len(m.edges[loc]))
+	for next := range m.edges[loc] {
+		locs = append(locs, next)
+	}
+	sort.Slice(locs, func(i, j int) bool { return locs[i] < locs[j] })
+	return locs
+}
+
+// Route is a way from one location to another.
+type Route struct {
+	// Path starts at the origin and ends at the destination.
+	Path  []Location
+	Ticks int
+}
+
+// Route finds the fastest route from one location to another with
+// Dijkstra's algorithm. Ties are always broken the same way, so every client
+// and the server agree on the route.
+func (m *Map) Route(from, to Location) (Route, error) {
+	if !m.Has(from) {
+		return Route{}, fmt.Errorf("%s is not a valid location", from)
+	}
+	if !m.Has(to) {
+		return Route{}, fmt.Errorf("%s is not a valid location", to)
+	}
+
+	dist := map[Location]int{from: 0}
+	prev := map[Location]Location{}
+	done := map[Location]bool{}
+	for {
+		// The board has a handful of locations, so a linear scan for the
+		// closest one is as good as a heap.
+		var next Location
+		found := false
+		for _, loc := range m.Locations() {
+			d, ok := dist[loc]
+			if !ok || done[loc] {
+				continue
+			}
+			if !found || d < dist[next] {
+				next, found = loc, true
+			}
+		}
+		if !found {
+			return Route{}, fmt.Errorf("there is no route from %s to %s", from, to)
+		}
+		if next == to {
+			break
+		}
+		done[next] = true
+
+		for _, neighbor := range m.Neighbors(next) {
+			d := dist[next] + m.edges[next][neighbor]
+			if known, ok := dist[neighbor]; !ok || d < known {
+				dist[neighbor] = d
+				prev[neighbor] = next
+			}
+		}
+	}
+
+	path := []Location{to}
+	for loc := to; loc != from; {
+		loc = prev[loc]
+		path = append([]Location{loc}, path...)
+	}
+	return Route{Path: path, Ticks: dist[to]}, nil
+}
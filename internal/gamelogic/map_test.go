@@ -0,0 +1,82 @@
+package gamelogic
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMapRoute(t *testing.T) {
+	// a - b - d is as fast as a - c - d, and a - d directly is slower.
+	m := NewMap()
+	m.Connect("a", "b", 1)
+	m.Connect("b", "d", 2)
+	m.Connect("a", "c", 2)
+	m.Connect("c", "d", 1)
+	m.Connect("a", "d", 5)
+	m.Connect("d", "e", 1)
+	m.AddLocation("island")
+
+	tests := []struct {
+		name    string
+		from    Location
+		to      Location
+		want    Route
+		wantErr string
+	}{
+		{name: "neighbours", from: "a", to: "b", want: Route{Path: []Location{"a", "b"}, Ticks: 1}},
+		{name: "both ways", from: "b", to: "a", want: Route{Path: []Location{"b", "a"}, Ticks: 1}},
+		{name: "several hops beat a slow route", from: "a", to: "e", want: Route{Path: []Location{"a", "b", "d", "e"}, Ticks: 4}},
+		{name: "ties break the same way", from: "a", to: "d", want: Route{Path: []Location{"a", "b", "d"}, Ticks: 3}},
+		{name: "nowhere", from: "a", to: "a", want: Route{Path: []Location{"a"}, Ticks: 0}},
+		{name: "unreachable", from: "a", to: "island", wantErr: "there is no route from a to island"},
+		{name: "unknown origin", from: "atlantis", to: "a", wantErr: "atlantis is not a valid location"},
+		{name: "unknown destination", from: "a", to: "atlantis", wantErr: "atlantis is not a valid location"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.Route(tt.from, tt.to)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Route returned %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Route(%s, %s) = %+v, want %+v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassicMapRoutes(t *testing.T) {
+	tests := []struct {
+		from, to Location
+		ticks    int
+	}{
+		{"americas", "asia", 4},
+		{"europe", "australia", 3},
+		{"antarctica", "asia", 4},
+	}
+
+	for _, tt := range tests {
+		route, err := currentMap().Route(tt.from, tt.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if route.Ticks != tt.ticks {
+			t.Errorf("%s to %s takes %d ticks, want %d", tt.from, tt.to, route.Ticks, tt.ticks)
+		}
+		back, err := currentMap().Route(tt.to, tt.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if back.Ticks != route.Ticks {
+			t.Errorf("%s to %s takes %d ticks, but %d back", tt.from, tt.to, route.Ticks, back.Ticks)
+		}
+	}
+}
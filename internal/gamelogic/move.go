@@ -3,6 +3,8 @@ package gamelogic
 import (
 	"errors"
 	"fmt"
+	"slices"
+	"sort"
 	"strconv"
 )
 
@@ -20,7 +22,11 @@ func (gs *GameState) HandleMove(move ArmyMove) MoveOutcome {
 
 	fmt.Println()
 	fmt.Println("==== Move Detected ====")
-	fmt.Printf("%s is moving %v unit(s) to %s\n", move.Player.Username, len(move.Units), move.ToLocation)
+	if move.Arrived {
+		fmt.Printf("%s's %v unit(s) arrived in %s\n", move.Player.Username, len(move.Units), move.ToLocation)
+	} else {
+		fmt.Printf("%s is moving %v unit(s) to %s\n", move.Player.Username, len(move.Units), move.ToLocation)
+	}
 	for _, unit := range move.Units {
 		fmt.Printf("* %v\n", unit.Rank)
 	}
@@ -29,56 +35,128 @@ func (gs *GameState) HandleMove(move ArmyMove) MoveOutcome {
 		return MoveOutcomeSamePlayer
 	}
 
-	overlappingLocation := getOverlappingLocation(player, move.Player)
-	if overlappingLocation != "" {
-		fmt.Printf("You have units in %s! You are at war with %s!\n", overlappingLocation, move.Player.Username)
+	// Travelling units are in no location, so they can't fight yet.
+	if !move.Arrived {
+		if len(move.Units) > 0 {
+			fmt.Printf("They arrive at tick %d.\n", move.Units[0].ArrivesAt)
+		}
+		return MoveOutComeSafe
+	}
+
+	if Allied(player.Username, move.Player.Username) {
+		fmt.Printf("%s is your ally.\n", move.Player.Username)
+		return MoveOutComeSafe
+	}
+
+	// The server only fights where the units arrived.
+	if slices.Contains(getOverlappingLocations(player, move.Player), move.ToLocation) {
+		fmt.Printf("You have units in %s! You are at war with %s!\n", move.ToLocation, move.Player.Username)
+		fmt.Printf("The server will fight over %s.\n", move.ToLocation)
 		return MoveOutcomeMakeWar
 	}
 	fmt.Printf("You are safe from %s's units.\n", move.Player.Username)
 	return MoveOutComeSafe
 }
 
-func getOverlappingLocation(p1 Player, p2 Player) Location {
+// HandleMoveVerdict reports the server's verdict on one of our moves or
+// spawns. A rejection means our units disagree with the server's, so they
+// are replaced with the server's. An accepted departure may arrive later
+// than we thought, if the server heard of it late.
+func (gs *GameState) HandleMoveVerdict(v MoveVerdict) {
+	if v.Accepted {
+		if v.Spawn == nil && !v.Move.Arrived {
+			gs.adoptArrivals(v.Player.Units)
+		}
+		return
+	}
+
+	defer fmt.Println("------------------------")
+	fmt.Println()
+	if v.Spawn != nil {
+		fmt.Printf("The server rejected your %s %d in %s: %s\n", v.Spawn.Unit.Rank, v.Spawn.Unit.ID, v.Spawn.Unit.Location, v.Reason)
+	} else {
+		fmt.Printf("The server rejected your move to %s: %s\n", v.Move.ToLocation, v.Reason)
+	}
+	gs.replaceUnits(v.Player.Units)
+	fmt.Printf("Your units were reset to the server's %d unit(s).\n", len(v.Player.Units))
+}
+
+// getOverlappingLocations returns every location both players have units
+// in, sorted.
+func getOverlappingLocations(p1 Player, p2 Player) []Location {
+	shared := map[Location]bool{}
 	for _, u1 := range p1.Units {
 		for _, u2 := range p2.Units {
-			if u1.Location == u2.Location {
-				return u1.Location
+			if !u1.InTransit() && u2.At(u1.Location) {
+				shared[u1.Location] = true
 			}
 		}
 	}
-	return ""
+
+	locs := make([]Location, 0, len(shared))
+	for loc := range shared {
+		locs = append(locs, loc)
+	}
+	sort.Slice(locs, func(i, j int) bool { return locs[i] < locs[j] })
+	return locs
 }
 
+// CommandMove sends units on their way to a location, along the fastest
+// route from the location they are all in. The returned move announces the
+// departure; Arrive announces the arrival.
 func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
-	if gs.isPaused() {
+	if gs.IsPaused() {
 		return ArmyMove{}, errors.New("the game is paused, you can not move units")
 	}
 	if len(words) < 3 {
 		return ArmyMove{}, errors.New("usage: move <location> <unitID> <unitID> <unitID> etc")
 	}
 	newLocation := Location(words[1])
-	locations := getAllLocations()
-	if _, ok := locations[newLocation]; !ok {
+	if !currentMap().Has(newLocation) {
 		return ArmyMove{}, fmt.Errorf("error: %s is not a valid location", newLocation)
 	}
 	unitIDs := []int{}
+	seen := map[int]bool{}
 	for _, word := range words[2:] {
 		id := word
 		unitID, err := strconv.Atoi(id)
 		if err != nil {
 			return ArmyMove{}, fmt.Errorf("error: %s is not a valid unit ID", id)
 		}
-		unitIDs = append(unitIDs, unitID)
+		if !seen[unitID] {
+			seen[unitID] = true
+			unitIDs = append(unitIDs, unitID)
+		}
 	}
 
-	newUnits := []Unit{}
+	var from Location
 	for _, unitID := range unitIDs {
 		unit, ok := gs.GetUnit(unitID)
 		if !ok {
 			return ArmyMove{}, fmt.Errorf("error: unit with ID %v not found", unitID)
 		}
-		unit.Location = newLocation
-		gs.UpdateUnit(unit)
+		if unit.InTransit() {
+			return ArmyMove{}, fmt.Errorf("error: unit %v is still on its way to %s", unitID, unit.Destination)
+		}
+		if from != "" && unit.Location != from {
+			return ArmyMove{}, errors.New("error: units moving together must start in the same location")
+		}
+		from = unit.Location
+	}
+	if from == newLocation {
+		return ArmyMove{}, fmt.Errorf("error: the units are already in %s", newLocation)
+	}
+
+	route, err := currentMap().Route(from, newLocation)
+	if err != nil {
+		return ArmyMove{}, fmt.Errorf("error: %v", err)
+	}
+	now := CurrentTick()
+	gs.departUnits(unitIDs, newLocation, now+Tick(route.Ticks))
+
+	newUnits := []Unit{}
+	for _, unitID := range unitIDs {
+		unit, _ := gs.GetUnit(unitID)
 		newUnits = append(newUnits, unit)
 	}
 
@@ -86,7 +164,40 @@ func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
 		ToLocation: newLocation,
 		Units:      newUnits,
 		Player:     gs.GetPlayerSnap(),
+		Path:       route.Path,
+		DepartedAt: now,
 	}
-	fmt.Printf("Moved %v units to %s\n", len(mv.Units), mv.ToLocation)
+	fmt.Printf("Moving %v units to %s via %v, arriving in %d tick(s)\n", len(mv.Units), mv.ToLocation, route.Path, route.Ticks)
 	return mv, nil
 }
+
+// Arrive lands the units due by now and returns a move announcing the
+// arrival in each location they reached.
+func (gs *GameState) Arrive(now Tick) []ArmyMove {
+	arrived := gs.arriveUnits(now)
+	if len(arrived) == 0 {
+		return nil
+	}
+
+	byLocation := map[Location][]Unit{}
+	for _, unit := range arrived {
+		byLocation[unit.Location] = append(byLocation[unit.Location], unit)
+	}
+
+	player := gs.GetPlayerSnap()
+	moves := []ArmyMove{}
+	for _, loc := range currentMap().Locations() {
+		units, ok := byLocation[loc]
+		if !ok {
+			continue
+		}
+		fmt.Printf("%v unit(s) arrived in %s\n", len(units), loc)
+		moves = append(moves, ArmyMove{
+			Player:     player,
+			Units:      units,
+			ToLocation: loc,
+			Arrived:    true,
+		})
+	}
+	return moves
+}
@@ -0,0 +1,429 @@
+package gamelogic
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Ruleset is everything about the game that isn't code: the units, what they
+// are worth, the board and how to win. The server loads it and every client
+// plays by the server's.
+type Ruleset struct {
+	Name      string      `json:"name" yaml:"name"`
+	Ranks     []RankRule  `json:"ranks" yaml:"ranks"`
+	Locations []Location  `json:"locations" yaml:"locations"`
+	Routes    []RouteRule `json:"routes" yaml:"routes"`
+	// Budget is what each player can spend on spawning units. Zero is no
+	// limit.
+	Budget int    `json:"budget" yaml:"budget"`
+	Combat Combat `json:"combat" yaml:"combat"`
+	// Alliances fight on the same side. Everyone else fights for themselves.
+	Alliances []Alliance `json:"alliances" yaml:"alliances"`
+	Victory   Victory    `json:"victory" yaml:"victory"`
+}
+
+type RankRule struct {
+	Name  UnitRank `json:"name" yaml:"name"`
+	Power int      `json:"power" yaml:"power"`
+	Cost  int      `json:"cost" yaml:"cost"`
+}
+
+// RouteRule connects two locations both ways.
+type RouteRule struct {
+	From  Location `json:"from" yaml:"from"`
+	To    Location `json:"to" yaml:"to"`
+	Ticks int      `json:"ticks" yaml:"ticks"`
+}
+
+// Combat picks the CombatResolver. Everything but Resolver only applies to
+// the dice.
+type Combat struct {
+	// Resolver is "power", the default, or "dice".
+	Resolver      string    `json:"resolver" yaml:"resolver"`
+	Seed          uint64    `json:"seed" yaml:"seed"`
+	Rounds        int       `json:"rounds" yaml:"rounds"`
+	DefenderBonus int       `json:"defender_bonus" yaml:"defender_bonus"`
+	Counters      []Counter `json:"counters" yaml:"counters"`
+}
+
+// Counter gives units of Rank a bonus when they fight units of Against.
+type Counter struct {
+	Rank    UnitRank `json:"rank" yaml:"rank"`
+	Against UnitRank `json:"against" yaml:"against"`
+	Bonus   int      `json:"bonus" yaml:"bonus"`
+}
+
+// Alliance is players who fight together and win together.
+type Alliance struct {
+	Name    string   `json:"name" yaml:"name"`
+	Players []string `json:"players" yaml:"players"`
+}
+
+// Victory says when a player, or an alliance, has won. With neither set the game never ends.
+type Victory struct {
+	// HoldLocations wins the game for a player who is alone, with their
+	// allies at most, in at least this many locations.
+	HoldLocations int `json:"hold_locations" yaml:"hold_locations"`
+	// LastStanding wins the game for the only player, or alliance, with units
+	// left, once at least two sides have played.
+	LastStanding bool `json:"last_standing" yaml:"last_standing"`
+}
+
+// DefaultRuleset is the classic game.
+func DefaultRuleset() Ruleset {
+	return Ruleset{
+		Name: "classic",
+		Ranks: []RankRule{
+			{Name: RankInfantry, Power: 1, Cost: 1},
+			{Name: RankCavalry, Power: 5, Cost: 3},
+			{Name: RankArtillery, Power: 10, Cost: 5},
+		},
+		Locations: []Location{"americas", "europe", "africa", "asia", "australia", "antarctica"},
+		Routes: []RouteRule{
+			{From: "americas", To: "europe", Ticks: 3},
+			{From: "americas", To: "africa", Ticks: 3},
+			{From: "americas", To: "asia", Ticks: 4},
+			{From: "americas", To: "antarctica", Ticks: 3},
+			{From: "europe", To: "africa", Ticks: 1},
+			{From: "europe", To: "asia", Ticks: 1},
+			{From: "africa", To: "asia", Ticks: 2},
+			{From: "africa", To: "antarctica", Ticks: 3},
+			{From: "asia", To: "australia", Ticks: 2},
+			{From: "australia", To: "antarctica", Ticks: 2},
+		},
+	}
+}
+
+// LoadRuleset reads a ruleset from a YAML file, which may also be JSON, and
+// validates it.
+func LoadRuleset(path string) (Ruleset, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Ruleset{}, fmt.Errorf("could not open rules file: %v", err)
+	}
+	defer f.Close()
+
+	var r Ruleset
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(&r)
+	if err != nil {
+		return Ruleset{}, fmt.Errorf("could not parse rules file %s: %v", path, err)
+	}
+
+	err = r.Validate()
+	if err != nil {
+		return Ruleset{}, err
+	}
+	return r, nil
+}
+
+// Validate reports every problem with the ruleset at once.
+func (r Ruleset) Validate() error {
+	errs := []error{}
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if r.Name == "" {
+		invalid("name: must not be empty")
+	}
+
+	if len(r.Ranks) == 0 {
+		invalid("ranks: at least one is needed")
+	}
+	ranks := map[UnitRank]bool{}
+	for i, rank := range r.Ranks {
+		switch {
+		case rank.Name == "":
+			invalid("ranks[%d].name: must not be empty", i)
+		case ranks[rank.Name]:
+			invalid("ranks[%d].name: %s is defined twice", i, rank.Name)
+		}
+		ranks[rank.Name] = true
+		if rank.Power < 0 {
+			invalid("ranks[%d].power: must not be negative, got %d", i, rank.Power)
+		}
+		if rank.Cost < 0 {
+			invalid("ranks[%d].cost: must not be negative, got %d", i, rank.Cost)
+		}
+	}
+
+	if len(r.Locations) == 0 {
+		invalid("locations: at least one is needed")
+	}
+	locations := map[Location]bool{}
+	for i, loc := range r.Locations {
+		switch {
+		case loc == "":
+			invalid("locations[%d]: must not be empty", i)
+		case locations[loc]:
+			invalid("locations[%d]: %s is defined twice", i, loc)
+		}
+		locations[loc] = true
+	}
+
+	routes := map[[2]Location]bool{}
+	for i, route := range r.Routes {
+		if !locations[route.From] {
+			invalid("routes[%d].from: %q is not a location", i, route.From)
+		}
+		if !locations[route.To] {
+			invalid("routes[%d].to: %q is not a location", i, route.To)
+		}
+		if route.From == route.To {
+			invalid("routes[%d]: %s is connected to itself", i, route.From)
+		}
+		if route.Ticks < 1 {
+			invalid("routes[%d].ticks: must be at least 1, got %d", i, route.Ticks)
+		}
+		key := routeKey(route)
+		if routes[key] {
+			invalid("routes[%d]: %s and %s are already connected", i, route.From, route.To)
+		}
+		routes[key] = true
+	}
+
+	if len(errs) == 0 && len(r.Locations) > 1 {
+		m := r.Map()
+		for _, loc := range r.Locations[1:] {
+			if _, err := m.Route(r.Locations[0], loc); err != nil {
+				invalid("routes: %v", err)
+			}
+		}
+	}
+
+	if r.Budget < 0 {
+		invalid("budget: must not be negative, got %d", r.Budget)
+	}
+
+	switch r.Combat.Resolver {
+	case "", "power", "dice":
+	default:
+		invalid("combat.resolver: must be power or dice, got %q", r.Combat.Resolver)
+	}
+	if r.Combat.Rounds < 0 {
+		invalid("combat.rounds: must not be negative, got %d", r.Combat.Rounds)
+	}
+	if r.Combat.DefenderBonus < 0 {
+		invalid("combat.defender_bonus: must not be negative, got %d", r.Combat.DefenderBonus)
+	}
+	for i, c := range r.Combat.Counters {
+		if !ranks[c.Rank] {
+			invalid("combat.counters[%d].rank: %q is not a rank", i, c.Rank)
+		}
+		if !ranks[c.Against] {
+			invalid("combat.counters[%d].against: %q is not a rank", i, c.Against)
+		}
+		if c.Bonus < 0 {
+			invalid("combat.counters[%d].bonus: must not be negative, got %d", i, c.Bonus)
+		}
+	}
+
+	alliances := map[string]bool{}
+	allied := map[string]string{}
+	for i, a := range r.Alliances {
+		switch {
+		case a.Name == "":
+			invalid("alliances[%d].name: must not be empty", i)
+		case alliances[a.Name]:
+			invalid("alliances[%d].name: %s is defined twice", i, a.Name)
+		}
+		alliances[a.Name] = true
+		if len(a.Players) < 2 {
+			invalid("alliances[%d].players: at least two are needed", i)
+		}
+		for j, username := range a.Players {
+			if username == "" {
+				invalid("alliances[%d].players[%d]: must not be empty", i, j)
+				continue
+			}
+			if other, ok := allied[username]; ok {
+				invalid("alliances[%d].players[%d]: %s is already in %s", i, j, username, other)
+			}
+			allied[username] = a.Name
+		}
+	}
+
+	if r.Victory.HoldLocations < 0 || r.Victory.HoldLocations > len(r.Locations) {
+		invalid("victory.hold_locations: must be between 0 and %d, got %d", len(r.Locations), r.Victory.HoldLocations)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid ruleset:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// routeKey is the same for a route in either direction.
+func routeKey(route RouteRule) [2]Location {
+	if route.From > route.To {
+		return [2]Location{route.To, route.From}
+	}
+	return [2]Location{route.From, route.To}
+}
+
+// Map builds the board the ruleset describes.
+func (r Ruleset) Map() *Map {
+	m := NewMap()
+	for _, loc := range r.Locations {
+		m.AddLocation(loc)
+	}
+	for _, route := range r.Routes {
+		m.Connect(route.From, route.To, route.Ticks)
+	}
+	return m
+}
+
+// Hash identifies the ruleset's rules. Rulesets that only list ranks,
+// locations or routes in a different order have the same hash.
+func (r Ruleset) Hash() string {
+	canonical := Ruleset{
+		Name:      r.Name,
+		Ranks:     append([]RankRule{}, r.Ranks...),
+		Locations: append([]Location{}, r.Locations...),
+		Routes:    make([]RouteRule, 0, len(r.Routes)),
+		Budget:    r.Budget,
+		Combat:    r.Combat,
+		Alliances: make([]Alliance, 0, len(r.Alliances)),
+		Victory:   r.Victory,
+	}
+	if canonical.Combat.Resolver == "" {
+		canonical.Combat.Resolver = "power"
+	}
+	sort.Slice(canonical.Ranks, func(i, j int) bool { return canonical.Ranks[i].Name < canonical.Ranks[j].Name })
+	sort.Slice(canonical.Locations, func(i, j int) bool { return canonical.Locations[i] < canonical.Locations[j] })
+	for _, route := range r.Routes {
+		key := routeKey(route)
+		canonical.Routes = append(canonical.Routes, RouteRule{From: key[0], To: key[1], Ticks: route.Ticks})
+	}
+	sort.Slice(canonical.Routes, func(i, j int) bool {
+		a, b := canonical.Routes[i], canonical.Routes[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+	for _, a := range r.Alliances {
+		players := append([]string{}, a.Players...)
+		sort.Strings(players)
+		canonical.Alliances = append(canonical.Alliances, Alliance{Name: a.Name, Players: players})
+	}
+	sort.Slice(canonical.Alliances, func(i, j int) bool { return canonical.Alliances[i].Name < canonical.Alliances[j].Name })
+
+	data, _ := json.Marshal(canonical)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// rulebook is a ruleset ready to play by.
+type rulebook struct {
+	rules    Ruleset
+	hash     string
+	board    *Map
+	ranks    map[UnitRank]RankRule
+	resolver CombatResolver
+	// alliances maps players to the alliance they are in.
+	alliances map[string]string
+}
+
+// active is swapped whole, since the server can change the rules while
+// handlers are using them.
+var active atomic.Pointer[rulebook]
+
+func init() {
+	active.Store(newRulebook(DefaultRuleset()))
+}
+
+func newRulebook(r Ruleset) *rulebook {
+	ranks := map[UnitRank]RankRule{}
+	for _, rank := range r.Ranks {
+		ranks[rank.Name] = rank
+	}
+	var resolver CombatResolver = PowerResolver{}
+	if r.Combat.Resolver == "dice" {
+		resolver = DiceResolver{
+			Seed:          r.Combat.Seed,
+			Rounds:        r.Combat.Rounds,
+			DefenderBonus: r.Combat.DefenderBonus,
+			Counters:      r.Combat.Counters,
+		}
+	}
+	alliances := map[string]string{}
+	for _, a := range r.Alliances {
+		for _, username := range a.Players {
+			alliances[username] = a.Name
+		}
+	}
+	return &rulebook{
+		rules:     r,
+		hash:      r.Hash(),
+		board:     r.Map(),
+		ranks:     ranks,
+		resolver:  resolver,
+		alliances: alliances,
+	}
+}
+
+// UseRuleset makes r the rules of the game. It reports whether they changed.
+func UseRuleset(r Ruleset) (bool, error) {
+	err := r.Validate()
+	if err != nil {
+		return false, err
+	}
+	book := newRulebook(r)
+	if active.Load().hash == book.hash {
+		return false, nil
+	}
+	active.Store(book)
+	return true, nil
+}
+
+// ActiveRuleset returns the rules of the game and their hash.
+func ActiveRuleset() (Ruleset, string) {
+	book := active.Load()
+	return book.rules, book.hash
+}
+
+// ActiveResolver returns the CombatResolver the rules pick.
+func ActiveResolver() CombatResolver {
+	return active.Load().resolver
+}
+
+func currentMap() *Map {
+	return active.Load().board
+}
+
+func rankRule(rank UnitRank) (RankRule, bool) {
+	rule, ok := active.Load().ranks[rank]
+	return rule, ok
+}
+
+// sideKey names the side a player fights on: their alliance, or themselves when
+// they aren't in one.
+type sideKey struct {
+	name     string
+	alliance bool
+}
+
+func sideOf(username string) sideKey {
+	if alliance, ok := active.Load().alliances[username]; ok {
+		return sideKey{name: alliance, alliance: true}
+	}
+	return sideKey{name: username}
+}
+
+// Allied reports whether two different players are in the same alliance.
+func Allied(a, b string) bool {
+	alliances := active.Load().alliances
+	alliance, ok := alliances[a]
+	return ok && a != b && alliances[b] == alliance
+}
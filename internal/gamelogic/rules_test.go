@@ -0,0 +1,171 @@
+package gamelogic
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRulesetValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(r *Ruleset)
+		// want lists a part of every problem reported, none when valid.
+		want []string
+	}{
+		{name: "classic", edit: func(r *Ruleset) {}},
+		{name: "dice", edit: func(r *Ruleset) {
+			r.Combat = Combat{Resolver: "dice", Rounds: 3, Counters: []Counter{{Rank: RankCavalry, Against: RankInfantry, Bonus: 2}}}
+		}},
+		{name: "no name", edit: func(r *Ruleset) { r.Name = "" }, want: []string{"name: must not be empty"}},
+		{name: "no ranks", edit: func(r *Ruleset) { r.Ranks = nil }, want: []string{"ranks: at least one is needed"}},
+		{
+			name: "bad ranks",
+			edit: func(r *Ruleset) {
+				r.Ranks = append(r.Ranks, RankRule{Name: RankInfantry}, RankRule{Name: "", Power: -1, Cost: -1})
+			},
+			want: []string{
+				"ranks[3].name: infantry is defined twice",
+				"ranks[4].name: must not be empty",
+				"ranks[4].power: must not be negative",
+				"ranks[4].cost: must not be negative",
+			},
+		},
+		{name: "duplicate location", edit: func(r *Ruleset) { r.Locations = append(r.Locations, "asia") }, want: []string{"locations[6]: asia is defined twice"}},
+		{
+			name: "bad routes",
+			edit: func(r *Ruleset) {
+				r.Routes = append(r.Routes,
+					RouteRule{From: "atlantis", To: "asia", Ticks: 1},
+					RouteRule{From: "asia", To: "asia", Ticks: 1},
+					RouteRule{From: "asia", To: "europe", Ticks: 0},
+				)
+			},
+			want: []string{
+				`routes[10].from: "atlantis" is not a location`,
+				"routes[11]: asia is connected to itself",
+				"routes[12].ticks: must be at least 1",
+				"routes[12]: asia and europe are already connected",
+			},
+		},
+		{name: "unreachable location", edit: func(r *Ruleset) { r.Locations = append(r.Locations, "island") }, want: []string{"routes: there is no route from americas to island"}},
+		{name: "negative budget", edit: func(r *Ruleset) { r.Budget = -1 }, want: []string{"budget: must not be negative"}},
+		{
+			name: "bad combat",
+			edit: func(r *Ruleset) {
+				r.Combat = Combat{Resolver: "chess", Rounds: -1, DefenderBonus: -1, Counters: []Counter{{Rank: "dragon", Against: RankInfantry, Bonus: -1}}}
+			},
+			want: []string{
+				`combat.resolver: must be power or dice, got "chess"`,
+				"combat.rounds: must not be negative",
+				"combat.defender_bonus: must not be negative",
+				`combat.counters[0].rank: "dragon" is not a rank`,
+				"combat.counters[0].bonus: must not be negative",
+			},
+		},
+		{
+			name: "bad alliances",
+			edit: func(r *Ruleset) {
+				r.Alliances = []Alliance{
+					{Name: "north", Players: []string{"alice", "bob"}},
+					{Name: "north", Players: []string{"bob"}},
+				}
+			},
+			want: []string{
+				"alliances[1].name: north is defined twice",
+				"alliances[1].players: at least two are needed",
+				"alliances[1].players[0]: bob is already in north",
+			},
+		},
+		{name: "hold too many locations", edit: func(r *Ruleset) { r.Victory.HoldLocations = 7 }, want: []string{"victory.hold_locations: must be between 0 and 6, got 7"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := DefaultRuleset()
+			tt.edit(&r)
+			err := r.Validate()
+
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate returned %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Validate accepted the ruleset")
+			}
+			// The first line introduces the problems, one per line.
+			problems := strings.Split(err.Error(), "\n")[1:]
+			if len(problems) != len(tt.want) {
+				t.Errorf("got %d problems, want %d:\n%v", len(problems), len(tt.want), err)
+			}
+			for _, want := range tt.want {
+				if !slices.ContainsFunc(problems, func(p string) bool { return strings.Contains(p, want) }) {
+					t.Errorf("no problem contains %q:\n%v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRulesetHash(t *testing.T) {
+	classic := DefaultRuleset()
+	hash := classic.Hash()
+
+	tests := []struct {
+		name string
+		edit func(r *Ruleset)
+		same bool
+	}{
+		{name: "unchanged", edit: func(r *Ruleset) {}, same: true},
+		{name: "ranks reordered", edit: func(r *Ruleset) { slices.Reverse(r.Ranks) }, same: true},
+		{name: "locations reordered", edit: func(r *Ruleset) { slices.Reverse(r.Locations) }, same: true},
+		{name: "routes reordered", edit: func(r *Ruleset) { slices.Reverse(r.Routes) }, same: true},
+		{name: "route reversed", edit: func(r *Ruleset) { r.Routes[0].From, r.Routes[0].To = r.Routes[0].To, r.Routes[0].From }, same: true},
+		{name: "power resolver named", edit: func(r *Ruleset) { r.Combat.Resolver = "power" }, same: true},
+		{name: "alliance", edit: func(r *Ruleset) {
+			r.Alliances = []Alliance{{Name: "north", Players: []string{"alice", "bob"}}}
+		}},
+		{name: "renamed", edit: func(r *Ruleset) { r.Name = "modern" }},
+		{name: "stronger infantry", edit: func(r *Ruleset) { r.Ranks[0].Power++ }},
+		{name: "slower route", edit: func(r *Ruleset) { r.Routes[0].Ticks++ }},
+		{name: "budget", edit: func(r *Ruleset) { r.Budget = 10 }},
+		{name: "dice", edit: func(r *Ruleset) { r.Combat.Resolver = "dice" }},
+		{name: "victory", edit: func(r *Ruleset) { r.Victory.LastStanding = true }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := DefaultRuleset()
+			tt.edit(&r)
+			if got := r.Hash(); (got == hash) != tt.same {
+				t.Errorf("Hash() = %.12s, classic is %.12s, want same: %v", got, hash, tt.same)
+			}
+		})
+	}
+
+	// Alliances are compared by their players, in any order.
+	a, b := DefaultRuleset(), DefaultRuleset()
+	a.Alliances = []Alliance{{Name: "north", Players: []string{"alice", "bob"}}, {Name: "south", Players: []string{"carol", "dave"}}}
+	b.Alliances = []Alliance{{Name: "south", Players: []string{"dave", "carol"}}, {Name: "north", Players: []string{"bob", "alice"}}}
+	if a.Hash() != b.Hash() {
+		t.Error("reordered alliances hash differently")
+	}
+}
+
+func TestLoadRulesetExample(t *testing.T) {
+	r, err := LoadRuleset(filepath.Join("..", "..", "rules.example.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Hash() == "" {
+		t.Error("the example ruleset has no hash")
+	}
+
+	_, err = LoadRuleset(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err == nil {
+		t.Error("LoadRuleset accepted a missing file")
+	}
+}
@@ -0,0 +1,131 @@
+package gamelogic
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SaveVersion is the version of the save format written by Save. Saves are
+// a player's event history, so replaying them restores exactly what was
+// saved.
+const SaveVersion = 1
+
+type SaveFile struct {
+	Version  int
+	Username string
+	SavedAt  time.Time
+	Events   []RecordedEvent
+}
+
+// Save writes the game state's history to path. The file is replaced in one
+// step, so a crash while saving leaves the previous save intact.
+func (gs *GameState) Save(path string) error {
+	save := SaveFile{
+		Version:  SaveVersion,
+		Username: gs.GetUsername(),
+		SavedAt:  time.Now(),
+		Events:   gs.Events(),
+	}
+
+	data, err := json.MarshalIndent(save, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode save: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not create save file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write save file: %v", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadSave reads a save written by Save, rejecting versions it doesn't know.
+func ReadSave(path string) (SaveFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return SaveFile{}, err
+	}
+
+	var save SaveFile
+	err = json.Unmarshal(data, &save)
+	if err != nil {
+		return SaveFile{}, fmt.Errorf("could not parse save %s: %v", path, err)
+	}
+	if save.Version != SaveVersion {
+		return SaveFile{}, fmt.Errorf("save %s has version %d, only version %d is supported", path, save.Version, SaveVersion)
+	}
+	return save, nil
+}
+
+// Restore replaces the game state's history with the one in save, which
+// must belong to the same player.
+func (gs *GameState) Restore(save SaveFile) error {
+	if save.Username != gs.GetUsername() {
+		return fmt.Errorf("the save belongs to %s, not %s", save.Username, gs.GetUsername())
+	}
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.events = append([]RecordedEvent{}, save.Events...)
+	gs.setState(Replay(save.Username, save.Events))
+	return nil
+}
+
+// SyncRequest asks the server for a player's units as its ledger knows them.
+// It is also the client's handshake, with the hash of the rules it plays by.
+type SyncRequest struct {
+	Username  string
+	RulesHash string
+}
+
+// SyncReply answers a SyncRequest. Known is false when the ledger has never
+// heard of the player. Rules is only set when the hashes differ.
+type SyncReply struct {
+	Player    Player
+	Known     bool
+	RulesHash string
+	Rules     *Ruleset
+}
+
+// Reconcile makes the server's view of the player's units the local one. A
+// player the server doesn't know has no units, whatever a save claims. It
+// reports whether anything changed.
+func (gs *GameState) Reconcile(reply SyncReply) bool {
+	units := map[int]Unit{}
+	if reply.Known {
+		units = reply.Player.Units
+	}
+
+	local := gs.GetPlayerSnap().Units
+	if len(local) == len(units) {
+		same := true
+		for id, unit := range units {
+			if local[id] != unit {
+				same = false
+				break
+			}
+		}
+		if same {
+			return false
+		}
+	}
+
+	gs.replaceUnits(units)
+	return true
+}
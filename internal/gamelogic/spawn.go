@@ -5,30 +5,65 @@ import (
 	"fmt"
 )
 
-func (gs *GameState) CommandSpawn(words []string) error {
+func (gs *GameState) CommandSpawn(words []string) (ArmySpawn, error) {
 	if len(words) < 3 {
-		return errors.New("usage: spawn <location> <rank>")
+		return ArmySpawn{}, errors.New("usage: spawn <location> <rank>")
 	}
 
 	locationName := words[1]
 	locations := getAllLocations()
 	if _, ok := locations[Location(locationName)]; !ok {
-		return fmt.Errorf("error: %s is not a valid location", locationName)
+		return ArmySpawn{}, fmt.Errorf("error: %s is not a valid location", locationName)
 	}
 
 	rank := words[2]
 	units := getAllRanks()
 	if _, ok := units[UnitRank(rank)]; !ok {
-		return fmt.Errorf("error: %s is not a valid unit", rank)
+		return ArmySpawn{}, fmt.Errorf("error: %s is not a valid unit", rank)
 	}
 
-	id := len(gs.getUnitsSnap()) + 1
-	gs.addUnit(Unit{
+	rules, _ := ActiveRuleset()
+	rule, _ := rankRule(UnitRank(rank))
+	if left := rules.Budget - gs.spent(); rules.Budget > 0 && rule.Cost > left {
+		return ArmySpawn{}, fmt.Errorf("error: a(n) %s costs %d, you have %d of your budget of %d left", rank, rule.Cost, left, rules.Budget)
+	}
+
+	id := gs.nextUnitID()
+	unit := Unit{
 		ID:       id,
 		Rank:     UnitRank(rank),
 		Location: Location(locationName),
-	})
+	}
+	gs.addUnit(unit)
 
 	fmt.Printf("Spawned a(n) %s in %s with id %v\n", rank, locationName, id)
-	return nil
+	return ArmySpawn{Username: gs.GetUsername(), Unit: unit}, nil
+}
+
+// spent is what the player paid for every unit they spawned, lost or not.
+func (gs *GameState) spent() int {
+	total := 0
+	for _, r := range gs.Events() {
+		if e, ok := r.Event.(UnitSpawned); ok {
+			rule, _ := rankRule(e.Unit.Rank)
+			total += rule.Cost
+		}
+	}
+	return total
+}
+
+// nextUnitID counts up from the highest ID the player ever spawned, like
+// spent, so a lost unit's ID is never reused. Units synced from the server
+// may have been spawned before the history began, so they count too.
+func (gs *GameState) nextUnitID() int {
+	id := 1
+	for _, r := range gs.Events() {
+		if e, ok := r.Event.(UnitSpawned); ok {
+			id = max(id, e.Unit.ID+1)
+		}
+	}
+	for _, unit := range gs.getUnitsSnap() {
+		id = max(id, unit.ID+1)
+	}
+	return id
 }
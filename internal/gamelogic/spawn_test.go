@@ -0,0 +1,41 @@
+package gamelogic
+
+import "testing"
+
+func TestNextUnitID(t *testing.T) {
+	infantry := func(id int) Unit {
+		return Unit{ID: id, Rank: RankInfantry, Location: "europe"}
+	}
+
+	tests := []struct {
+		name   string
+		events []Event
+		want   int
+	}{
+		{"no units", nil, 1},
+		{"after spawns", []Event{UnitSpawned{infantry(1)}, UnitSpawned{infantry(2)}}, 3},
+		{
+			name:   "highest unit lost",
+			events: []Event{UnitSpawned{infantry(1)}, UnitSpawned{infantry(2)}, UnitsDestroyed{Location: "europe", UnitIDs: []int{2}}},
+			want:   3,
+		},
+		{
+			name:   "every unit lost",
+			events: []Event{UnitSpawned{infantry(1)}, UnitsDestroyed{Location: "europe", UnitIDs: []int{1}}},
+			want:   2,
+		},
+		{"synced from the server", []Event{UnitsSynced{Units: []Unit{infantry(7)}}}, 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := NewGameState("alice")
+			for _, e := range tt.events {
+				gs.record(e)
+			}
+			if got := gs.nextUnitID(); got != tt.want {
+				t.Errorf("nextUnitID() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
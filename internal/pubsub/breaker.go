@@ -0,0 +1,284 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrBrokerUnavailable is returned instead of talking to the broker while the
+// circuit breaker is open.
+var ErrBrokerUnavailable = errors.New("broker unavailable")
+
+// errDial marks a failure to connect to the broker.
+var errDial = errors.New("could not connect")
+
+type BreakerState int
+
+const (
+	// BreakerClosed lets every operation through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails every operation with ErrBrokerUnavailable.
+	BreakerOpen
+	// BreakerHalfOpen lets a few probes through to see if the broker
+	// recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+type BreakerOptions struct {
+	// Window is how long failures are counted before the counts start over,
+	// 10s when zero.
+	Window time.Duration
+	// MinRequests is how many operations a window needs before its failure
+	// ratio can open the breaker, 5 when zero.
+	MinRequests int
+	// FailureRatio opens the breaker once this share of a window's operations
+	// failed, 0.5 when zero.
+	FailureRatio float64
+	// OpenFor is how long the breaker stays open before it lets probes
+	// through, 5s when zero.
+	OpenFor time.Duration
+	// Probes is how many operations must succeed in a row while half-open to
+	// close the breaker, 1 when zero.
+	Probes int
+}
+
+// BreakerEvent reports a state change. Err is the failure that opened the
+// breaker, if any.
+type BreakerEvent struct {
+	From BreakerState
+	To   BreakerState
+	At   time.Time
+	Err  error
+}
+
+// Breaker fails broker operations fast while too many of them recently
+// failed, so callers don't each wait for their own timeout.
+type Breaker struct {
+	opts BreakerOptions
+
+	mu          sync.Mutex
+	state       BreakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     int
+	succeeded   int
+	// period counts state changes, so an operation's outcome is only
+	// recorded in the state it was admitted under.
+	period int
+
+	events chan BreakerEvent
+}
+
+func NewBreaker(opts BreakerOptions) *Breaker {
+	if opts.Window == 0 {
+		opts.Window = 10 * time.Second
+	}
+	if opts.MinRequests == 0 {
+		opts.MinRequests = 5
+	}
+	if opts.FailureRatio == 0 {
+		opts.FailureRatio = 0.5
+	}
+	if opts.OpenFor == 0 {
+		opts.OpenFor = 5 * time.Second
+	}
+	if opts.Probes == 0 {
+		opts.Probes = 1
+	}
+
+	return &Breaker{
+		opts:        opts,
+		windowStart: time.Now(),
+		events:      make(chan BreakerEvent, 10),
+	}
+}
+
+// DefaultBreaker guards every publish and declare made by this package.
+var DefaultBreaker = NewBreaker(BreakerOptions{})
+
+// Events reports state changes. Like Subscription.Errors, sends never block,
+// so events are dropped when nobody is reading.
+func (b *Breaker) Events() <-chan BreakerEvent {
+	return b.events
+}
+
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance(time.Now())
+	return b.state
+}
+
+// Do runs f unless the breaker is open, and records whether it failed.
+// Only broker failures count: see brokerFailure.
+func (b *Breaker) Do(f func() error) error {
+	period, ok := b.allow()
+	if !ok {
+		return ErrBrokerUnavailable
+	}
+
+	err := f()
+	b.record(period, err)
+	return err
+}
+
+// Wait blocks until the breaker lets operations through again or ctx is done.
+func (b *Breaker) Wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.advance(now)
+		remaining := b.openedAt.Add(b.opts.OpenFor).Sub(now)
+		open := b.state == BreakerOpen
+		b.mu.Unlock()
+
+		if !open {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// allow admits an operation and returns the period it was admitted in.
+func (b *Breaker) allow() (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance(time.Now())
+	switch b.state {
+	case BreakerOpen:
+		return 0, false
+	case BreakerHalfOpen:
+		if b.probing >= b.opts.Probes {
+			return 0, false
+		}
+		b.probing++
+	}
+	return b.period, true
+}
+
+// record counts the outcome of an operation admitted in period. Operations
+// that finish after the state changed say nothing about the new state: a call
+// started while closed is no probe, and a probe started before the breaker
+// reopened no longer holds a probe slot.
+func (b *Breaker) record(period int, err error) {
+	failed := brokerFailure(err)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if period != b.period {
+		return
+	}
+	now := time.Now()
+	switch b.state {
+	case BreakerHalfOpen:
+		b.probing--
+		if failed {
+			b.transition(BreakerOpen, now, err)
+			return
+		}
+		b.succeeded++
+		if b.succeeded >= b.opts.Probes {
+			b.transition(BreakerClosed, now, nil)
+		}
+
+	case BreakerClosed:
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= b.opts.MinRequests &&
+			float64(b.failures)/float64(b.requests) >= b.opts.FailureRatio {
+			b.transition(BreakerOpen, now, err)
+		}
+	}
+}
+
+// brokerFailure reports whether err says the broker is unreachable or
+// unhealthy: a closed connection or channel, a network error, a timeout or a
+// failed dial. Errors the broker answered with, like a missing exchange or a
+// queue declared with other arguments, and cancelled contexts don't count.
+func brokerFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errDial) ||
+		errors.Is(err, amqp.ErrClosed) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) {
+		// Channel exceptions are recoverable; connection exceptions aren't.
+		return !amqpErr.Recover
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// advance moves an open breaker to half-open once OpenFor elapsed and starts
+// a new counting window when the current one is over. Callers must hold b.mu.
+func (b *Breaker) advance(now time.Time) {
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.opts.OpenFor {
+		b.transition(BreakerHalfOpen, now, nil)
+	}
+	if b.state == BreakerClosed && now.Sub(b.windowStart) >= b.opts.Window {
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+	}
+}
+
+// transition changes the state and reports it. Callers must hold b.mu.
+func (b *Breaker) transition(to BreakerState, now time.Time, err error) {
+	from := b.state
+	b.state = to
+	b.period++
+	switch to {
+	case BreakerOpen:
+		b.openedAt = now
+	case BreakerHalfOpen:
+		b.probing = 0
+		b.succeeded = 0
+	case BreakerClosed:
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+	}
+
+	select {
+	case b.events <- BreakerEvent{From: from, To: to, At: now, Err: err}:
+	default:
+	}
+}
+
+// guard runs a broker operation through DefaultBreaker.
+func guard(f func() error) error {
+	return DefaultBreaker.Do(f)
+}
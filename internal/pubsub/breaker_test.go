@@ -0,0 +1,228 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestBrokerFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"cancelled", context.Canceled, false},
+		{"deadline", fmt.Errorf("publish: %w", context.DeadlineExceeded), true},
+		{"dial", fmt.Errorf("%w: %w", errDial, errors.New("refused")), true},
+		{"closed", amqp.ErrClosed, true},
+		{"eof", io.EOF, true},
+		{"connection forced", &amqp.Error{Code: amqp.ConnectionForced, Reason: "shutdown"}, true},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("refused")}, true},
+		{"not found", &amqp.Error{Code: amqp.NotFound, Recover: true}, false},
+		{"precondition failed", fmt.Errorf("could not declare x: %w", &amqp.Error{Code: amqp.PreconditionFailed, Recover: true}), false},
+		{"other", errors.New("could not encode"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := brokerFailure(tt.err); got != tt.want {
+				t.Errorf("brokerFailure(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerStates(t *testing.T) {
+	var (
+		down     = amqp.ErrClosed
+		notFound = &amqp.Error{Code: amqp.NotFound, Recover: true}
+	)
+	const openFor = 20 * time.Millisecond
+
+	// Each step runs one operation failing with err, or waits when wait is
+	// set, then checks the breaker's state.
+	type step struct {
+		err  error
+		wait time.Duration
+		want BreakerState
+	}
+
+	tests := []struct {
+		name  string
+		opts  BreakerOptions
+		steps []step
+	}{
+		{
+			name: "opens at the failure ratio",
+			opts: BreakerOptions{MinRequests: 4, FailureRatio: 0.5},
+			steps: []step{
+				{err: nil, want: BreakerClosed},
+				{err: down, want: BreakerClosed},
+				{err: nil, want: BreakerClosed},
+				{err: down, want: BreakerOpen},
+			},
+		},
+		{
+			name: "needs enough requests",
+			opts: BreakerOptions{MinRequests: 3},
+			steps: []step{
+				{err: down, want: BreakerClosed},
+				{err: down, want: BreakerClosed},
+				{err: down, want: BreakerOpen},
+			},
+		},
+		{
+			name: "ignores errors the broker answered",
+			opts: BreakerOptions{MinRequests: 2},
+			steps: []step{
+				{err: notFound, want: BreakerClosed},
+				{err: notFound, want: BreakerClosed},
+				{err: notFound, want: BreakerClosed},
+			},
+		},
+		{
+			name: "closes after a successful probe",
+			opts: BreakerOptions{MinRequests: 1, OpenFor: openFor},
+			steps: []step{
+				{err: down, want: BreakerOpen},
+				{wait: 2 * openFor, want: BreakerHalfOpen},
+				{err: nil, want: BreakerClosed},
+			},
+		},
+		{
+			name: "a probe answered with a channel error closes",
+			opts: BreakerOptions{MinRequests: 1, OpenFor: openFor},
+			steps: []step{
+				{err: down, want: BreakerOpen},
+				{wait: 2 * openFor, want: BreakerHalfOpen},
+				{err: notFound, want: BreakerClosed},
+			},
+		},
+		{
+			name: "reopens after a failed probe",
+			opts: BreakerOptions{MinRequests: 1, OpenFor: openFor},
+			steps: []step{
+				{err: down, want: BreakerOpen},
+				{wait: 2 * openFor, want: BreakerHalfOpen},
+				{err: down, want: BreakerOpen},
+			},
+		},
+		{
+			name: "needs every probe to succeed",
+			opts: BreakerOptions{MinRequests: 1, OpenFor: openFor, Probes: 2},
+			steps: []step{
+				{err: down, want: BreakerOpen},
+				{wait: 2 * openFor, want: BreakerHalfOpen},
+				{err: nil, want: BreakerHalfOpen},
+				{err: nil, want: BreakerClosed},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBreaker(tt.opts)
+			for i, s := range tt.steps {
+				if s.wait > 0 {
+					time.Sleep(s.wait)
+				} else {
+					err := b.Do(func() error { return s.err })
+					if err != s.err {
+						t.Fatalf("step %d: Do returned %v, want %v", i, err, s.err)
+					}
+				}
+				if got := b.State(); got != s.want {
+					t.Fatalf("step %d: state %s, want %s", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerFailsFast(t *testing.T) {
+	b := NewBreaker(BreakerOptions{MinRequests: 1, OpenFor: time.Hour})
+	b.Do(func() error { return amqp.ErrClosed })
+
+	called := false
+	err := b.Do(func() error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, ErrBrokerUnavailable) || called {
+		t.Errorf("open breaker returned %v and called f: %v", err, called)
+	}
+}
+
+func TestBreakerLimitsProbes(t *testing.T) {
+	b := NewBreaker(BreakerOptions{MinRequests: 1, OpenFor: time.Millisecond})
+	b.Do(func() error { return amqp.ErrClosed })
+	time.Sleep(5 * time.Millisecond)
+
+	// The one probe allowed is in flight while another operation arrives.
+	err := b.Do(func() error {
+		if err := b.Do(func() error { return nil }); !errors.Is(err, ErrBrokerUnavailable) {
+			t.Errorf("second probe returned %v, want ErrBrokerUnavailable", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.State(); got != BreakerClosed {
+		t.Errorf("state %s after the probe succeeded, want closed", got)
+	}
+}
+
+func TestBreakerIgnoresOperationsFromBeforeHalfOpen(t *testing.T) {
+	b := NewBreaker(BreakerOptions{MinRequests: 2, OpenFor: time.Millisecond})
+
+	// Started while closed, this operation finishes after the breaker opened
+	// and went half-open. It is no probe.
+	b.Do(func() error {
+		b.Do(func() error { return amqp.ErrClosed })
+		b.Do(func() error { return amqp.ErrClosed })
+		time.Sleep(5 * time.Millisecond)
+		if got := b.State(); got != BreakerHalfOpen {
+			t.Fatalf("state %s, want half-open", got)
+		}
+		return nil
+	})
+	if got := b.State(); got != BreakerHalfOpen {
+		t.Fatalf("state %s after an operation from before, want half-open", got)
+	}
+
+	err := b.Do(func() error {
+		if err := b.Do(func() error { return nil }); !errors.Is(err, ErrBrokerUnavailable) {
+			t.Errorf("second probe returned %v, want ErrBrokerUnavailable", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.State(); got != BreakerClosed {
+		t.Errorf("state %s after the probe succeeded, want closed", got)
+	}
+}
+
+func TestBreakerEvents(t *testing.T) {
+	b := NewBreaker(BreakerOptions{MinRequests: 1})
+	b.Do(func() error { return amqp.ErrClosed })
+
+	select {
+	case ev := <-b.Events():
+		if ev.From != BreakerClosed || ev.To != BreakerOpen || !errors.Is(ev.Err, amqp.ErrClosed) {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	default:
+		t.Fatal("no event for the breaker opening")
+	}
+}
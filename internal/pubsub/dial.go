@@ -0,0 +1,219 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type DialOptions struct {
+	// CAFile is a PEM bundle of certificate authorities trusted on top of the
+	// system ones.
+	CAFile string
+	// CertFile and KeyFile are the PEM client certificate and key presented
+	// for mutual TLS.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the host name the server certificate is checked
+	// against.
+	ServerName string
+	// External authenticates with SASL EXTERNAL, letting the broker take the
+	// user from the client certificate instead of asking for a password.
+	External bool
+	// Credentials replaces the user and password in the URL.
+	Credentials CredentialsProvider
+	// RefreshEvery asks Credentials again at this interval and hands the new
+	// password to the broker, for tokens that expire. Zero never refreshes.
+	RefreshEvery time.Duration
+}
+
+// TLS reports whether any TLS option is set.
+func (o DialOptions) TLS() bool {
+	return o.CAFile != "" || o.CertFile != "" || o.KeyFile != "" || o.ServerName != ""
+}
+
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// CredentialsProvider supplies broker credentials. It is asked when dialing
+// and, with DialOptions.RefreshEvery, again whenever the password should be
+// renewed.
+type CredentialsProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+type CredentialsFunc func(ctx context.Context) (Credentials, error)
+
+func (f CredentialsFunc) Credentials(ctx context.Context) (Credentials, error) {
+	return f(ctx)
+}
+
+// EnvCredentials reads the user and password from environment variables.
+func EnvCredentials(usernameVar, passwordVar string) CredentialsProvider {
+	return CredentialsFunc(func(context.Context) (Credentials, error) {
+		username, ok := os.LookupEnv(usernameVar)
+		if !ok {
+			return Credentials{}, fmt.Errorf("%s is not set", usernameVar)
+		}
+		password, ok := os.LookupEnv(passwordVar)
+		if !ok {
+			return Credentials{}, fmt.Errorf("%s is not set", passwordVar)
+		}
+		return Credentials{Username: username, Password: password}, nil
+	})
+}
+
+// FileCredentials reads the password from a file, such as a mounted secret,
+// every time it is asked, so replacing the file rotates the password.
+func FileCredentials(username, passwordFile string) CredentialsProvider {
+	return CredentialsFunc(func(context.Context) (Credentials, error) {
+		b, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("could not read password file: %v", err)
+		}
+		return Credentials{Username: username, Password: strings.TrimSpace(string(b))}, nil
+	})
+}
+
+// TokenCredentials uses a token, such as an OAuth 2 access token, as the
+// password. token is called for every new token.
+func TokenCredentials(username string, token func(ctx context.Context) (string, error)) CredentialsProvider {
+	return CredentialsFunc(func(ctx context.Context) (Credentials, error) {
+		t, err := token(ctx)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("could not get token: %v", err)
+		}
+		return Credentials{Username: username, Password: t}, nil
+	})
+}
+
+// Dial connects to the broker at rawURL. Errors never include the URL's
+// password.
+func Dial(rawURL string, opts DialOptions) (*amqp.Connection, error) {
+	uri, err := amqp.ParseURI(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse broker url %s: %v", RedactURL(rawURL), err)
+	}
+
+	cfg := amqp.Config{Locale: "en_US"}
+
+	if opts.TLS() || opts.External {
+		if uri.Scheme != "amqps" {
+			return nil, errors.New("TLS options need an amqps:// broker url")
+		}
+		cfg.TLSClientConfig, err = opts.tlsConfig(uri.Host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case opts.External:
+		if opts.CertFile == "" {
+			return nil, errors.New("SASL EXTERNAL needs a client certificate")
+		}
+		cfg.SASL = []amqp.Authentication{&amqp.ExternalAuth{}}
+
+	case opts.Credentials != nil:
+		creds, err := opts.Credentials.Credentials(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("could not get broker credentials: %v", err)
+		}
+		cfg.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: creds.Username, Password: creds.Password}}
+	}
+
+	conn, err := amqp.DialConfig(rawURL, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %v", RedactURL(rawURL), err)
+	}
+
+	if opts.Credentials != nil && !opts.External && opts.RefreshEvery > 0 {
+		go refreshCredentials(conn, opts.Credentials, opts.RefreshEvery)
+	}
+
+	return conn, nil
+}
+
+func (o DialOptions) tlsConfig(host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: host,
+	}
+	if o.ServerName != "" {
+		cfg.ServerName = o.ServerName
+	}
+
+	if o.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// refreshCredentials renews the connection's password until it closes.
+func refreshCredentials(conn *amqp.Connection, provider CredentialsProvider, every time.Duration) {
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), every)
+		creds, err := provider.Credentials(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Could not refresh broker credentials: %v\n", err)
+			continue
+		}
+
+		err = conn.UpdateSecret(creds.Password, "credentials refreshed")
+		if err != nil {
+			log.Printf("Could not update broker credentials: %v\n", err)
+		}
+	}
+}
+
+// RedactURL hides the password of a broker url so it can be logged.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// Don't echo something that might be a malformed secret.
+		return "<invalid url>"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,130 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Fetched is a message pulled with Fetch. It stays unacknowledged until one of
+// its methods, or AckBatch/NackBatch, is called.
+type Fetched[T any] struct {
+	Message[T]
+	ContentType string
+	Raw         []byte
+	// DecodeErr is set when Raw could not be decoded into T. The message is
+	// still returned so it can be inspected and acknowledged.
+	DecodeErr error
+
+	delivery amqp.Delivery
+}
+
+func (f *Fetched[T]) Ack() error {
+	return f.delivery.Ack(false)
+}
+
+func (f *Fetched[T]) Nack(requeue bool) error {
+	return f.delivery.Nack(false, requeue)
+}
+
+const (
+	fetchMinPoll = 20 * time.Millisecond
+	fetchMaxPoll = 500 * time.Millisecond
+)
+
+// Fetch pulls up to max messages from queue with basic.get, waiting at most
+// wait for the queue to fill up. Each message is decoded with the codec
+// matching its content type. Fetched messages must all be acknowledged on ch,
+// so keep the channel open until they are.
+func Fetch[T any](ctx context.Context, ch *amqp.Channel, queue string, max int, wait time.Duration) ([]Fetched[T], error) {
+	deadline := time.Now().Add(wait)
+	poll := fetchMinPoll
+
+	msgs := []Fetched[T]{}
+	for len(msgs) < max {
+		delivery, ok, err := ch.Get(queue, false)
+		if err != nil {
+			return msgs, err
+		}
+
+		if ok {
+			msgs = append(msgs, newFetched[T](queue, delivery))
+			poll = fetchMinPoll
+			continue
+		}
+
+		if !time.Now().Before(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return msgs, ctx.Err()
+		case <-time.After(min(poll, time.Until(deadline))):
+		}
+		poll = min(poll*2, fetchMaxPoll)
+	}
+
+	return msgs, nil
+}
+
+func newFetched[T any](queue string, delivery amqp.Delivery) Fetched[T] {
+	f := Fetched[T]{
+		Message: Message[T]{
+			Queue:         queue,
+			RoutingKey:    delivery.RoutingKey,
+			MessageID:     delivery.MessageId,
+			Headers:       delivery.Headers,
+			Redelivered:   delivery.Redelivered,
+			ReplyTo:       delivery.ReplyTo,
+			CorrelationID: delivery.CorrelationId,
+			Timestamp:     delivery.Timestamp,
+		},
+		ContentType: delivery.ContentType,
+		Raw:         delivery.Body,
+		delivery:    delivery,
+	}
+
+	codec, err := CodecFor(delivery.ContentType)
+	if err != nil {
+		f.DecodeErr = err
+		return f
+	}
+	f.DecodeErr = codec.Decode(delivery.Body, &f.Message.Body)
+	return f
+}
+
+// AckBatch acknowledges msgs with a single basic.ack. Because it acks with
+// multiple=true, every earlier unacknowledged message fetched on the same
+// channel is acknowledged too.
+func AckBatch[T any](msgs []Fetched[T]) error {
+	last, ok := lastFetched(msgs)
+	if !ok {
+		return nil
+	}
+	return last.delivery.Ack(true)
+}
+
+// NackBatch rejects msgs with a single basic.nack, with the same multiple=true
+// caveat as AckBatch.
+func NackBatch[T any](msgs []Fetched[T], requeue bool) error {
+	last, ok := lastFetched(msgs)
+	if !ok {
+		return nil
+	}
+	return last.delivery.Nack(true, requeue)
+}
+
+func lastFetched[T any](msgs []Fetched[T]) (Fetched[T], bool) {
+	if len(msgs) == 0 {
+		return Fetched[T]{}, false
+	}
+
+	last := msgs[0]
+	for _, msg := range msgs[1:] {
+		if msg.delivery.DeliveryTag > last.delivery.DeliveryTag {
+			last = msg
+		}
+	}
+	return last, true
+}
@@ -0,0 +1,163 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// GatherReply is what responders send back to a ScatterGather broadcast.
+type GatherReply struct {
+	Responder string
+}
+
+type GatherResult struct {
+	// Acknowledged lists expected responders that replied in time.
+	Acknowledged []string
+	// Missing lists expected responders that did not reply in time.
+	Missing []string
+	// Unexpected lists responders that replied without being expected.
+	Unexpected []string
+}
+
+// ScatterGather publishes val on topic with a private reply queue and
+// collects GatherReplies until every expected responder answered or wait
+// elapsed. Subscribers answer with Reply.
+func ScatterGather[T any](
+	ctx context.Context,
+	conn *amqp.Connection,
+	topic Topic[T],
+	val T,
+	expected []string,
+	wait time.Duration,
+) (GatherResult, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return GatherResult{}, err
+	}
+	defer ch.Close()
+
+	replies, correlationID, err := publishForReplies(ctx, ch, topic, val)
+	if err != nil {
+		return GatherResult{}, err
+	}
+
+	waiting := map[string]bool{}
+	for _, responder := range expected {
+		waiting[responder] = true
+	}
+	result := GatherResult{}
+	seen := map[string]bool{}
+
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+collect:
+	for len(waiting) > 0 || len(expected) == 0 {
+		select {
+		case <-ctx.Done():
+			break collect
+		case delivery, ok := <-replies:
+			if !ok {
+				break collect
+			}
+			if delivery.CorrelationId != correlationID {
+				continue
+			}
+
+			var reply GatherReply
+			if err := json.Unmarshal(delivery.Body, &reply); err != nil || seen[reply.Responder] {
+				continue
+			}
+			seen[reply.Responder] = true
+
+			if waiting[reply.Responder] {
+				delete(waiting, reply.Responder)
+				result.Acknowledged = append(result.Acknowledged, reply.Responder)
+			} else {
+				result.Unexpected = append(result.Unexpected, reply.Responder)
+			}
+		}
+	}
+
+	for responder := range waiting {
+		result.Missing = append(result.Missing, responder)
+	}
+	sort.Strings(result.Acknowledged)
+	sort.Strings(result.Missing)
+	sort.Strings(result.Unexpected)
+
+	return result, nil
+}
+
+// Reply answers a message published by ScatterGather. It does nothing for
+// messages that did not ask for a reply.
+func Reply[T any](ch *amqp.Channel, msg Message[T], responder string) error {
+	if msg.ReplyTo == "" {
+		return nil
+	}
+
+	encoded, err := json.Marshal(GatherReply{Responder: responder})
+	if err != nil {
+		return err
+	}
+
+	return guard(func() error {
+		return ch.PublishWithContext(context.Background(), "", msg.ReplyTo, false, false, amqp.Publishing{
+			ContentType:   JSON.ContentType(),
+			CorrelationId: msg.CorrelationID,
+			Body:          encoded,
+		})
+	})
+}
+
+// publishForReplies publishes val on topic with a new reply queue on ch, and
+// returns the replies and the correlation ID they must carry.
+func publishForReplies[T any](
+	ctx context.Context,
+	ch *amqp.Channel,
+	topic Topic[T],
+	val T,
+) (<-chan amqp.Delivery, string, error) {
+	replyQueue, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not declare reply queue: %v", err)
+	}
+
+	replies, err := ch.Consume(replyQueue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not consume replies: %v", err)
+	}
+
+	encoded, err := topic.Codec.Encode(val)
+	if err != nil {
+		return nil, "", err
+	}
+
+	correlationID := newID()
+	err = guard(func() error {
+		return ch.PublishWithContext(ctx, topic.Exchange, topic.Key(val), false, false, amqp.Publishing{
+			ContentType:   topic.Codec.ContentType(),
+			ReplyTo:       replyQueue.Name,
+			CorrelationId: correlationID,
+			Body:          encoded,
+		})
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("could not publish to %s: %w", topic.Name, err)
+	}
+	return replies, correlationID, nil
+}
+
+// newID returns a random ID for correlating or telling apart messages.
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,506 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const DeadLetterExchange = "peril_dlx"
+
+// Message is a decoded delivery together with the metadata a Handler may need.
+type Message[T any] struct {
+	Body          T
+	Queue         string
+	RoutingKey    string
+	MessageID     string
+	Headers       amqp.Table
+	Redelivered   bool
+	ReplyTo       string
+	CorrelationID string
+	Timestamp     time.Time
+}
+
+// Handler processes one message. Its context is cancelled when the
+// subscription is closed or the handler runs longer than
+// SubscribeOptions.HandlerTimeout. A returned error is logged, counted in the
+// queue's Stats and, for NackDiscard, attached to the dead-lettered message.
+type Handler[T any] func(ctx context.Context, msg Message[T]) (Acktype, error)
+
+// Adapt turns a plain func(T) Acktype handler into a Handler.
+func Adapt[T any](handler func(T) Acktype) Handler[T] {
+	return func(_ context.Context, msg Message[T]) (Acktype, error) {
+		return handler(msg.Body), nil
+	}
+}
+
+type SubscribeOptions struct {
+	// Prefetch limits unacknowledged deliveries, 10 when zero.
+	Prefetch int
+	// Concurrency is how many handlers may run at once, 1 when zero. Messages
+	// are only handled in order when it is 1, and it should not exceed
+	// Prefetch.
+	Concurrency int
+	// HandlerTimeout cancels a handler's context after it ran this long. Zero
+	// means no timeout.
+	HandlerTimeout time.Duration
+	// OnCancel decides what happens when the broker cancels the consumer, for
+	// example because its queue was deleted.
+	OnCancel CancelPolicy
+	// ResubscribeAttempts limits how often CancelResubscribe tries to
+	// redeclare the queue, 5 when zero.
+	ResubscribeAttempts int
+	// ResubscribeDelay is the pause before the first attempt, doubled after
+	// every failure, 1s when zero.
+	ResubscribeDelay time.Duration
+}
+
+type CancelPolicy int
+
+const (
+	// CancelResubscribe redeclares and rebinds the queue and resumes
+	// consuming.
+	CancelResubscribe CancelPolicy = iota
+	// CancelStop ends the subscription.
+	CancelStop
+)
+
+var ErrConsumerCancelled = errors.New("consumer cancelled by the broker")
+
+// Subscription is a running consumer started by SubscribeContext.
+type Subscription struct {
+	queue  string
+	cancel context.CancelFunc
+	done   chan struct{}
+	errs   chan error
+}
+
+// Errors reports problems that do not belong to a single handler call, such
+// as the delivery channel closing unexpectedly. Sends never block: errors are
+// dropped when nobody is reading.
+func (s *Subscription) Errors() <-chan error {
+	return s.errs
+}
+
+func (s *Subscription) Queue() string {
+	return s.queue
+}
+
+// Close cancels the consumer and waits for the running handler to return.
+func (s *Subscription) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// Done is closed once the subscription stopped consuming.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscription) report(err error) {
+	select {
+	case s.errs <- err:
+	default:
+	}
+}
+
+func SubscribeContext[T any](
+	ctx context.Context,
+	conn *amqp.Connection,
+	topic Topic[T],
+	queueName string,
+	queueType simpleQueueType,
+	handler Handler[T],
+	opts SubscribeOptions,
+) (*Subscription, error) {
+	declare := bindKey(conn, topic.Exchange, queueName, topic.Pattern, queueType)
+	return consume(ctx, conn, queueName, declare, topic.Codec, handler, opts)
+}
+
+// declareFunc declares and binds the queue a subscription consumes from and
+// returns the channel to consume on. It runs again on every resubscribe.
+type declareFunc func() (*amqp.Channel, error)
+
+// bindKey declares queueName and binds it to exchange with a routing key.
+func bindKey(conn *amqp.Connection, exchange, queueName, key string, queueType simpleQueueType) declareFunc {
+	return func() (*amqp.Channel, error) {
+		ch, queue, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Queue %v declared and bound!\n", queue.Name)
+		return ch, nil
+	}
+}
+
+func consume[T any](
+	ctx context.Context,
+	conn *amqp.Connection,
+	queueName string,
+	declare declareFunc,
+	codec Codec,
+	handler Handler[T],
+	opts SubscribeOptions,
+) (*Subscription, error) {
+	if opts.Prefetch == 0 {
+		opts.Prefetch = 10
+	}
+	if opts.ResubscribeAttempts == 0 {
+		opts.ResubscribeAttempts = 5
+	}
+	if opts.ResubscribeDelay == 0 {
+		opts.ResubscribeDelay = time.Second
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = 1
+	}
+
+	c, err := startConsumer(queueName, declare, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &Subscription{
+		queue:  queueName,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		errs:   make(chan error, 10),
+	}
+
+	go func() {
+		// Handlers ack on the channel they were delivered on, so it stays
+		// open until every running handler returned.
+		var running sync.WaitGroup
+		slots := make(chan struct{}, opts.Concurrency)
+
+		defer close(sub.done)
+		defer func() {
+			running.Wait()
+			c.ch.Close()
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case delivery, ok := <-c.deliveries:
+				if ok {
+					select {
+					case slots <- struct{}{}:
+					case <-ctx.Done():
+						return
+					}
+					running.Add(1)
+					go func(ch *amqp.Channel) {
+						defer running.Done()
+						defer func() { <-slots }()
+						handleDelivery(ctx, ch, queueName, codec, handler, opts, delivery)
+					}(c.ch)
+					continue
+				}
+
+				// The library reports a basic.cancel before it closes the
+				// delivery channel; anything else means the channel or
+				// connection is gone.
+				var tag string
+				select {
+				case tag = <-c.cancels:
+				default:
+					sub.report(fmt.Errorf("delivery channel for %s closed", queueName))
+					return
+				}
+
+				sub.report(fmt.Errorf("%w: %s (consumer %s)", ErrConsumerCancelled, queueName, tag))
+				if opts.OnCancel == CancelStop {
+					return
+				}
+
+				running.Wait()
+				c.ch.Close()
+				next, err := resubscribe(ctx, queueName, declare, opts)
+				if err != nil {
+					sub.report(fmt.Errorf("could not resubscribe to %s: %v", queueName, err))
+					return
+				}
+				c = next
+				log.Printf("Resubscribed to %s\n", queueName)
+			}
+		}
+	}()
+
+	return sub, nil
+}
+
+type consumer struct {
+	ch         *amqp.Channel
+	deliveries <-chan amqp.Delivery
+	cancels    chan string
+}
+
+func startConsumer(queueName string, declare declareFunc, opts SubscribeOptions) (consumer, error) {
+	ch, err := declare()
+	if err != nil {
+		return consumer{}, fmt.Errorf("could not subscribe to %s: %v", queueName, err)
+	}
+
+	err = ch.Qos(opts.Prefetch, 0, false)
+	if err != nil {
+		ch.Close()
+		return consumer{}, err
+	}
+
+	// Dead letters are published on this channel and only acked once the
+	// broker has confirmed them.
+	err = ch.Confirm(false)
+	if err != nil {
+		ch.Close()
+		return consumer{}, err
+	}
+
+	// Buffered: the library blocks on this send before it closes deliveries.
+	cancels := ch.NotifyCancel(make(chan string, 1))
+
+	deliveries, err := ch.Consume(queueName, "", false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return consumer{}, err
+	}
+
+	return consumer{
+		ch:         ch,
+		deliveries: deliveries,
+		cancels:    cancels,
+	}, nil
+}
+
+func resubscribe(ctx context.Context, queueName string, declare declareFunc, opts SubscribeOptions) (consumer, error) {
+	delay := opts.ResubscribeDelay
+	var err error
+	for attempt := 0; attempt < opts.ResubscribeAttempts; attempt++ {
+		select {
+		case <-ctx.Done():
+			return consumer{}, ctx.Err()
+		case <-time.After(delay):
+		}
+
+		var c consumer
+		c, err = startConsumer(queueName, declare, opts)
+		if err == nil {
+			return c, nil
+		}
+		delay *= 2
+	}
+	return consumer{}, err
+}
+
+func handleDelivery[T any](
+	ctx context.Context,
+	ch *amqp.Channel,
+	queueName string,
+	codec Codec,
+	handler Handler[T],
+	opts SubscribeOptions,
+	delivery amqp.Delivery,
+) {
+	stats := statsFor(queueName)
+	stats.delivered()
+
+	msg := Message[T]{
+		Queue:         queueName,
+		RoutingKey:    delivery.RoutingKey,
+		MessageID:     delivery.MessageId,
+		Headers:       delivery.Headers,
+		Redelivered:   delivery.Redelivered,
+		ReplyTo:       delivery.ReplyTo,
+		CorrelationID: delivery.CorrelationId,
+		Timestamp:     delivery.Timestamp,
+	}
+
+	var ackt Acktype
+	var err error
+	if derr := decode(codec, delivery.ContentType, delivery.Body, &msg.Body); derr != nil {
+		ackt, err = NackDiscard, fmt.Errorf("could not decode message: %v", derr)
+	} else {
+		hctx, cancel := ctx, context.CancelFunc(func() {})
+		if opts.HandlerTimeout > 0 {
+			hctx, cancel = context.WithTimeout(ctx, opts.HandlerTimeout)
+		}
+		ackt, err = handler(hctx, msg)
+		cancel()
+	}
+
+	if err != nil {
+		stats.failed(err)
+		log.Printf("Handler error on %s (%s): %v\n", queueName, delivery.RoutingKey, err)
+	}
+
+	switch ackt {
+	case Ack:
+		log.Println("Ack handled")
+		stats.acked()
+		delivery.Ack(false)
+	case NackRequeue:
+		log.Println("Nack with requeue handled")
+		stats.requeued()
+		if errors.Is(err, ErrBrokerUnavailable) {
+			// Requeueing now would redeliver the message straight away and
+			// fail again, so hold on to it until the breaker lets a probe
+			// through.
+			DefaultBreaker.Wait(ctx)
+		}
+		delivery.Nack(false, true)
+	case NackDiscard:
+		log.Println("Nack with discard handled")
+		stats.discarded()
+		if err == nil {
+			delivery.Nack(false, false)
+			return
+		}
+		// Dead-letter the message ourselves so the reason travels with it.
+		if derr := deadLetter(ch, queueName, delivery, err); derr != nil {
+			log.Printf("Could not dead-letter message from %s: %v\n", queueName, derr)
+			delivery.Nack(false, false)
+			return
+		}
+		delivery.Ack(false)
+	}
+}
+
+func deadLetter(ch *amqp.Channel, queueName string, delivery amqp.Delivery, reason error) error {
+	headers := amqp.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	headers["x-peril-error"] = reason.Error()
+	headers["x-peril-queue"] = queueName
+	headers["x-peril-routing-key"] = delivery.RoutingKey
+	if errors.Is(reason, context.DeadlineExceeded) {
+		headers["x-peril-timeout"] = true
+	}
+
+	return guard(func() error {
+		confirm, err := ch.PublishWithDeferredConfirmWithContext(context.Background(), deadLetterExchange, delivery.RoutingKey, false, false, amqp.Publishing{
+			Headers:       headers,
+			ContentType:   delivery.ContentType,
+			DeliveryMode:  delivery.DeliveryMode,
+			CorrelationId: delivery.CorrelationId,
+			ReplyTo:       delivery.ReplyTo,
+			Timestamp:     delivery.Timestamp,
+			Body:          delivery.Body,
+		})
+		if err != nil {
+			return err
+		}
+
+		// The original is acked on return, so the dead letter must be safe
+		// with the broker first.
+		ctx, cancel := context.WithTimeout(context.Background(), deadLetterConfirm)
+		defer cancel()
+		acked, err := confirm.WaitContext(ctx)
+		if err != nil {
+			return err
+		}
+		if !acked {
+			return errors.New("broker nacked the dead letter")
+		}
+		return nil
+	})
+}
+
+// deadLetterConfirm bounds the wait for the broker to confirm a dead letter.
+const deadLetterConfirm = 5 * time.Second
+
+// QueueStats counts what happened to the messages consumed from a queue.
+type QueueStats struct {
+	Delivered int
+	Acked     int
+	Requeued  int
+	Discarded int
+	Errors    int
+	LastError string
+}
+
+type queueStats struct {
+	mu sync.Mutex
+	QueueStats
+}
+
+var (
+	statsMu sync.Mutex
+	stats   = map[string]*queueStats{}
+)
+
+func statsFor(queueName string) *queueStats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	s, ok := stats[queueName]
+	if !ok {
+		s = &queueStats{}
+		stats[queueName] = s
+	}
+	return s
+}
+
+// Stats returns a snapshot of the counters of every queue consumed by this
+// process.
+func Stats() map[string]QueueStats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	snapshot := map[string]QueueStats{}
+	for name, s := range stats {
+		s.mu.Lock()
+		snapshot[name] = s.QueueStats
+		s.mu.Unlock()
+	}
+	return snapshot
+}
+
+// PrintStats writes the breaker's state and the counters of every queue,
+// sorted by name, to w.
+func PrintStats(w io.Writer) {
+	fmt.Fprintf(w, "broker circuit: %s\n", DefaultBreaker.State())
+
+	stats := Stats()
+	queues := make([]string, 0, len(stats))
+	for queue := range stats {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+
+	for _, queue := range queues {
+		s := stats[queue]
+		fmt.Fprintf(w, "* %s: %d delivered, %d acked, %d requeued, %d discarded, %d errors\n",
+			queue, s.Delivered, s.Acked, s.Requeued, s.Discarded, s.Errors)
+		if s.LastError != "" {
+			fmt.Fprintf(w, "    last error: %s\n", s.LastError)
+		}
+	}
+}
+
+func (s *queueStats) delivered() { s.update(func(q *QueueStats) { q.Delivered++ }) }
+func (s *queueStats) acked()     { s.update(func(q *QueueStats) { q.Acked++ }) }
+func (s *queueStats) requeued()  { s.update(func(q *QueueStats) { q.Requeued++ }) }
+func (s *queueStats) discarded() { s.update(func(q *QueueStats) { q.Discarded++ }) }
+
+func (s *queueStats) failed(err error) {
+	s.update(func(q *QueueStats) {
+		q.Errors++
+		q.LastError = err.Error()
+	})
+}
+
+func (s *queueStats) update(f func(*QueueStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.QueueStats)
+}
@@ -0,0 +1,40 @@
+package pubsub
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPrintStats(t *testing.T) {
+	withBreaker(t, NewBreaker(BreakerOptions{}))
+
+	b := statsFor("print_stats.b")
+	b.delivered()
+	b.discarded()
+	b.failed(errors.New("boom"))
+	a := statsFor("print_stats.a")
+	a.delivered()
+	a.acked()
+
+	var out strings.Builder
+	PrintStats(&out)
+	got := out.String()
+
+	want := []string{
+		"broker circuit: closed\n",
+		"* print_stats.a: 1 delivered, 1 acked, 0 requeued, 0 discarded, 0 errors\n",
+		"* print_stats.b: 1 delivered, 0 acked, 0 requeued, 1 discarded, 1 errors\n    last error: boom\n",
+	}
+	last := -1
+	for _, line := range want {
+		i := strings.Index(got, line)
+		if i < 0 {
+			t.Fatalf("PrintStats output is missing %q:\n%s", line, got)
+		}
+		if i < last {
+			t.Errorf("%q is out of order:\n%s", line, got)
+		}
+		last = i
+	}
+}
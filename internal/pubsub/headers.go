@@ -0,0 +1,186 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// A headers exchange routes on message headers instead of the routing key.
+// DeclareHeadersExchange binds one behind a topic exchange, so publishers keep
+// publishing to the topic exchange and only set Topic.Headers, while
+// subscribers that care about a small part of the traffic bind with a
+// HeaderFilter.
+
+type HeaderMatch string
+
+const (
+	// MatchAll routes a message when every filter header is present with the
+	// same value.
+	MatchAll HeaderMatch = "all"
+	// MatchAny routes a message when at least one filter header matches.
+	MatchAny HeaderMatch = "any"
+)
+
+type HeaderFilter struct {
+	Match   HeaderMatch
+	Headers map[string]any
+}
+
+// Empty reports whether the filter has no headers. An empty filter is not
+// bound at all, because the broker would route every message to it.
+func (f HeaderFilter) Empty() bool {
+	return len(f.Headers) == 0
+}
+
+func (f HeaderFilter) args() amqp.Table {
+	match := f.Match
+	if match == "" {
+		match = MatchAll
+	}
+
+	table := amqp.Table{"x-match": string(match)}
+	for k, v := range f.Headers {
+		table[k] = v
+	}
+	return table
+}
+
+// DeclareHeadersExchange declares a durable headers exchange and binds it to
+// source, so it receives every message published there under pattern.
+func DeclareHeadersExchange(ch *amqp.Channel, name, source, pattern string) error {
+	return guard(func() error {
+		err := ch.ExchangeDeclare(name, amqp.ExchangeHeaders, true, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not declare %s: %w", name, err)
+		}
+
+		err = ch.ExchangeBind(name, pattern, source, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not bind %s to %s: %w", name, source, err)
+		}
+		return nil
+	})
+}
+
+// HeaderSubscription is a subscription to a headers exchange whose filter
+// can be changed while it runs.
+type HeaderSubscription struct {
+	*Subscription
+
+	conn     *amqp.Connection
+	exchange string
+
+	mu     sync.Mutex
+	filter HeaderFilter
+}
+
+// SubscribeHeaders consumes the messages of topic that reach exchange, a
+// headers exchange, and match filter. The topic only provides the codec.
+func SubscribeHeaders[T any](
+	ctx context.Context,
+	conn *amqp.Connection,
+	exchange string,
+	topic Topic[T],
+	queueName string,
+	queueType simpleQueueType,
+	filter HeaderFilter,
+	handler Handler[T],
+	opts SubscribeOptions,
+) (*HeaderSubscription, error) {
+	hs := &HeaderSubscription{
+		conn:     conn,
+		exchange: exchange,
+		filter:   filter,
+	}
+
+	declare := func() (*amqp.Channel, error) {
+		var ch *amqp.Channel
+		err := guard(func() error {
+			var err error
+			ch, err = hs.declare(queueName, queueType)
+			return err
+		})
+		return ch, err
+	}
+
+	sub, err := consume(ctx, conn, queueName, declare, topic.Codec, handler, opts)
+	if err != nil {
+		return nil, err
+	}
+	hs.Subscription = sub
+	return hs, nil
+}
+
+func (s *HeaderSubscription) declare(queueName string, queueType simpleQueueType) (*amqp.Channel, error) {
+	ch, err := s.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	queue, err := declareQueue(ch, queueName, queueType)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	// Hold the lock while binding, so a concurrent SetFilter can't leave a
+	// stale binding behind after a resubscribe.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.filter.Empty() {
+		err = ch.QueueBind(queueName, "", s.exchange, false, s.filter.args())
+		if err != nil {
+			ch.Close()
+			return nil, err
+		}
+	}
+	fmt.Printf("Queue %v declared and bound!\n", queue.Name)
+	return ch, nil
+}
+
+func (s *HeaderSubscription) Filter() HeaderFilter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filter
+}
+
+// SetFilter replaces the queue's binding. The new binding is added before the
+// old one is removed, so no matching message is missed in between.
+func (s *HeaderSubscription) SetFilter(filter HeaderFilter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Binding the same arguments twice is a no-op, so unbinding afterwards
+	// would remove the only binding.
+	if reflect.DeepEqual(filter.args(), s.filter.args()) {
+		return nil
+	}
+
+	ch, err := s.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	queueName := s.Queue()
+	if !filter.Empty() {
+		err = ch.QueueBind(queueName, "", s.exchange, false, filter.args())
+		if err != nil {
+			return fmt.Errorf("could not bind %s: %v", queueName, err)
+		}
+	}
+
+	if !s.filter.Empty() {
+		err = ch.QueueUnbind(queueName, "", s.exchange, s.filter.args())
+		if err != nil {
+			return fmt.Errorf("could not unbind %s: %v", queueName, err)
+		}
+	}
+
+	s.filter = filter
+	return nil
+}
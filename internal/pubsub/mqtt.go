@@ -0,0 +1,759 @@
+package pubsub
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTTTransport speaks MQTT 3.1.1 or 5 to RabbitMQ's rabbitmq_mqtt plugin. The
+// plugin publishes every MQTT message to a single topic exchange (configured
+// with mqtt.exchange, peril_topic in our Dockerfile) and translates topics, so
+// army_moves/alice on the MQTT side is army_moves.alice on the AMQP side.
+//
+// Subscriptions use QoS 1. Ack and NackDiscard send a PUBACK, since MQTT has no
+// negative acknowledgement; with MQTT 5 a discarding PUBACK carries reason code
+// 0x80. NackRequeue hands the message to the handler again after
+// MQTTOptions.RequeueDelay, doubling each time, and gives up with a discarding
+// PUBACK after MaxRequeues.
+//
+// Only MQTT 5 carries the content type of a message.
+type MQTTTransport struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	exchange string
+	opts     MQTTOptions
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu      sync.Mutex
+	nextID  uint16
+	subs    []*mqttSubscription
+	pending map[uint16]chan error
+	err     error
+	closed  chan struct{}
+}
+
+type MQTTOptions struct {
+	ClientID string
+	Username string
+	Password string
+	// Version is MQTT311, the default, or MQTT5.
+	Version byte
+	// CleanSession drops queued messages and subscriptions on disconnect.
+	// Leave it false for durable subscriptions.
+	CleanSession bool
+	// SessionExpiry is how long an MQTT 5 broker keeps a session that isn't
+	// clean once disconnected, a day when zero. MQTT 3.1.1 brokers decide
+	// themselves.
+	SessionExpiry time.Duration
+	KeepAlive     time.Duration
+	// RequeueDelay is the pause before the first redelivery of a message
+	// handled with NackRequeue, one second when zero. MaxRequeues is how
+	// often a message is redelivered, five times when zero.
+	RequeueDelay time.Duration
+	MaxRequeues  int
+}
+
+const (
+	MQTT311 byte = 4
+	MQTT5   byte = 5
+)
+
+type mqttSubscription struct {
+	filter   string
+	messages *mailbox[mqttPublish]
+}
+
+type mqttPublish struct {
+	topic       string
+	packetID    uint16
+	contentType string
+	payload     []byte
+	// requeues counts the handler's NackRequeues.
+	requeues int
+}
+
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublishType = 3
+	mqttPuback      = 4
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+var ErrMQTTClosed = errors.New("mqtt transport closed")
+
+func DialMQTT(addr, exchange string, opts MQTTOptions) (*MQTTTransport, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := NewMQTTTransport(conn, exchange, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// NewMQTTTransport performs the MQTT handshake on an already established
+// connection. exchange is the AMQP exchange the broker's MQTT plugin is
+// configured to use.
+func NewMQTTTransport(conn net.Conn, exchange string, opts MQTTOptions) (*MQTTTransport, error) {
+	if opts.Version == 0 {
+		opts.Version = MQTT311
+	}
+	if opts.Version != MQTT311 && opts.Version != MQTT5 {
+		return nil, fmt.Errorf("unsupported mqtt protocol version %d", opts.Version)
+	}
+	if opts.SessionExpiry == 0 {
+		opts.SessionExpiry = 24 * time.Hour
+	}
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = 30 * time.Second
+	}
+	if opts.RequeueDelay == 0 {
+		opts.RequeueDelay = time.Second
+	}
+	if opts.MaxRequeues == 0 {
+		opts.MaxRequeues = 5
+	}
+
+	t := &MQTTTransport{
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		w:        bufio.NewWriter(conn),
+		exchange: exchange,
+		opts:     opts,
+		pending:  map[uint16]chan error{},
+		closed:   make(chan struct{}),
+	}
+
+	var flags byte
+	if opts.CleanSession {
+		flags |= 0x02
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+	}
+
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	body = append(body, opts.Version, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(opts.KeepAlive/time.Second))
+	if opts.Version == MQTT5 {
+		var props []byte
+		if !opts.CleanSession {
+			props = append(props, mqttSessionExpiry)
+			props = binary.BigEndian.AppendUint32(props, uint32(opts.SessionExpiry/time.Second))
+		}
+		body = appendMQTTProperties(body, props)
+	}
+	body = appendMQTTString(body, opts.ClientID)
+	if opts.Username != "" {
+		body = appendMQTTString(body, opts.Username)
+	}
+	if opts.Password != "" {
+		body = appendMQTTString(body, opts.Password)
+	}
+
+	if err := t.writePacket(mqttConnect<<4, body); err != nil {
+		return nil, err
+	}
+
+	header, payload, err := readMQTTPacket(t.r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CONNACK: %v", err)
+	}
+	if header>>4 != mqttConnack || len(payload) < 2 {
+		return nil, fmt.Errorf("unexpected packet type %d during connect", header>>4)
+	}
+	// MQTT 3.1.1 return codes are all refusals, MQTT 5 reason codes from
+	// 0x80 on.
+	if payload[1] != 0 {
+		return nil, fmt.Errorf("mqtt connect refused with code 0x%02x", payload[1])
+	}
+
+	go t.readLoop()
+	go t.keepAlive(opts.KeepAlive)
+
+	return t, nil
+}
+
+// AMQPKeyToMQTTTopic translates an AMQP routing key or binding pattern such
+// as army_moves.* into the MQTT topic or filter army_moves/+.
+func AMQPKeyToMQTTTopic(key string) string {
+	words := strings.Split(key, ".")
+	for i, word := range words {
+		switch word {
+		case "*":
+			words[i] = "+"
+		default:
+			words[i] = strings.ReplaceAll(word, "/", ".")
+		}
+	}
+	return strings.Join(words, "/")
+}
+
+// MQTTTopicToAMQPKey is the inverse of AMQPKeyToMQTTTopic.
+func MQTTTopicToAMQPKey(topic string) string {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		switch level {
+		case "+":
+			levels[i] = "*"
+		default:
+			levels[i] = strings.ReplaceAll(level, ".", "/")
+		}
+	}
+	return strings.Join(levels, ".")
+}
+
+func mqttTopicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+func (t *MQTTTransport) Publish(exchange, key string, env Envelope) error {
+	if exchange != t.exchange {
+		return fmt.Errorf("mqtt transport can only publish to %s, not %s", t.exchange, exchange)
+	}
+
+	id, done, err := t.track()
+	if err != nil {
+		return err
+	}
+
+	body := appendMQTTPublish(nil, t.opts.Version, mqttPublish{
+		topic:       AMQPKeyToMQTTTopic(key),
+		packetID:    id,
+		contentType: env.ContentType,
+		payload:     env.Body,
+	})
+
+	// QoS 1: the broker confirms with a PUBACK.
+	if err := t.writePacket(mqttPublishType<<4|1<<1, body); err != nil {
+		return err
+	}
+	return t.wait(id, done, "PUBLISH")
+}
+
+// Subscribe subscribes to the MQTT filter equivalent of key. The broker's
+// MQTT plugin manages one queue per client, so queueName and queueType are
+// decided by the client ID and MQTTOptions.CleanSession instead.
+func (t *MQTTTransport) Subscribe(
+	exchange,
+	queueName,
+	key string,
+	queueType simpleQueueType,
+	handler func(Envelope) Acktype,
+) error {
+	if exchange != t.exchange {
+		return fmt.Errorf("mqtt transport can only subscribe to %s, not %s", t.exchange, exchange)
+	}
+
+	sub := &mqttSubscription{
+		filter:   AMQPKeyToMQTTTopic(key),
+		messages: newMailbox[mqttPublish](),
+	}
+
+	id, done, err := t.track()
+	if err != nil {
+		return err
+	}
+	// The broker may deliver before its SUBACK arrives, so the subscription
+	// is registered first and removed again if it is refused.
+	t.mu.Lock()
+	t.subs = append(t.subs, sub)
+	t.mu.Unlock()
+
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, id)
+	if t.opts.Version == MQTT5 {
+		body = appendMQTTProperties(body, nil)
+	}
+	body = appendMQTTString(body, sub.filter)
+	// Maximum QoS 1, which MQTT 5 calls the subscription options.
+	body = append(body, 1)
+
+	if err := t.writePacket(mqttSubscribe<<4|0x02, body); err != nil {
+		t.unsubscribe(sub)
+		return err
+	}
+	if err := t.wait(id, done, "SUBSCRIBE"); err != nil {
+		t.unsubscribe(sub)
+		return fmt.Errorf("could not subscribe to %s: %v", sub.filter, err)
+	}
+	fmt.Printf("Subscribed to %v!\n", sub.filter)
+
+	// Handlers run off the read loop, so they may publish and subscribe
+	// themselves.
+	go func() {
+		for {
+			msg, ok := sub.messages.get()
+			if !ok {
+				return
+			}
+
+			ackt := handler(Envelope{
+				RoutingKey:  MQTTTopicToAMQPKey(msg.topic),
+				ContentType: msg.contentType,
+				Body:        msg.payload,
+			})
+			if ackt == NackRequeue {
+				if msg.requeues < t.opts.MaxRequeues {
+					delay := t.opts.RequeueDelay << msg.requeues
+					msg.requeues++
+					time.AfterFunc(delay, func() { sub.messages.put(msg) })
+					continue
+				}
+				log.Printf("Discarding message on %s after %d requeues\n", msg.topic, msg.requeues)
+			}
+
+			if err := t.puback(msg.packetID, ackt != Ack); err != nil {
+				log.Printf("Error acknowledging message: %v\n", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// puback acknowledges a QoS 1 message, as discarded when MQTT 5 can say so.
+func (t *MQTTTransport) puback(packetID uint16, discarded bool) error {
+	if packetID == 0 {
+		return nil
+	}
+
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, packetID)
+	if discarded && t.opts.Version == MQTT5 {
+		body = append(body, mqttUnspecifiedError)
+	}
+	return t.writePacket(mqttPuback<<4, body)
+}
+
+func (t *MQTTTransport) Close() error {
+	err := t.writePacket(mqttDisconnect<<4, nil)
+	closeErr := t.conn.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (t *MQTTTransport) track() (uint16, chan error, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.err != nil {
+		return 0, nil, t.err
+	}
+
+	// Packet IDs must be non-zero.
+	t.nextID++
+	if t.nextID == 0 {
+		t.nextID++
+	}
+	done := make(chan error, 1)
+	t.pending[t.nextID] = done
+	return t.nextID, done, nil
+}
+
+func (t *MQTTTransport) wait(id uint16, done chan error, what string) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.mu.Lock()
+		delete(t.pending, id)
+		t.mu.Unlock()
+		return fmt.Errorf("no acknowledgement for %s %d", what, id)
+	}
+}
+
+func (t *MQTTTransport) resolve(id uint16, err error) {
+	t.mu.Lock()
+	done, ok := t.pending[id]
+	delete(t.pending, id)
+	t.mu.Unlock()
+	if ok {
+		done <- err
+	}
+}
+
+func (t *MQTTTransport) readLoop() {
+	var err error
+	for {
+		var header byte
+		var payload []byte
+		header, payload, err = readMQTTPacket(t.r)
+		if err != nil {
+			break
+		}
+
+		switch header >> 4 {
+		case mqttPublishType:
+			msg, perr := parseMQTTPublish(header, payload, t.opts.Version)
+			if perr != nil {
+				err = perr
+				break
+			}
+			t.dispatch(msg)
+		case mqttPuback:
+			// MQTT 5 may add a reason code, failures from 0x80 on.
+			if len(payload) >= 2 {
+				var perr error
+				if len(payload) >= 3 && payload[2] >= 0x80 {
+					perr = fmt.Errorf("publish refused by broker with code 0x%02x", payload[2])
+				}
+				t.resolve(binary.BigEndian.Uint16(payload), perr)
+			}
+		case mqttSuback:
+			t.resolveSuback(payload)
+		case mqttDisconnect:
+			// Only MQTT 5 brokers disconnect their clients with a reason.
+			err = ErrMQTTClosed
+			if len(payload) > 0 {
+				err = fmt.Errorf("disconnected by broker with code 0x%02x", payload[0])
+			}
+		case mqttPingresp:
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		err = ErrMQTTClosed
+	}
+
+	t.mu.Lock()
+	t.err = err
+	for _, sub := range t.subs {
+		sub.messages.close()
+	}
+	t.subs = nil
+	for id, done := range t.pending {
+		done <- err
+		delete(t.pending, id)
+	}
+	t.mu.Unlock()
+	close(t.closed)
+	t.conn.Close()
+}
+
+func (t *MQTTTransport) dispatch(msg mqttPublish) {
+	t.mu.Lock()
+	var target *mqttSubscription
+	for _, sub := range t.subs {
+		if mqttTopicMatches(sub.filter, msg.topic) {
+			target = sub
+			break
+		}
+	}
+	t.mu.Unlock()
+
+	// Nobody reads the message, but a persistent session would keep it
+	// unacknowledged on the broker.
+	if target == nil {
+		log.Printf("Discarding message on %s: no matching subscription\n", msg.topic)
+		if err := t.puback(msg.packetID, true); err != nil {
+			log.Printf("Error acknowledging message: %v\n", err)
+		}
+		return
+	}
+	target.messages.put(msg)
+}
+
+// unsubscribe forgets a subscription the broker refused, and discards what
+// was delivered to it meanwhile.
+func (t *MQTTTransport) unsubscribe(sub *mqttSubscription) {
+	t.mu.Lock()
+	t.subs = slices.DeleteFunc(t.subs, func(s *mqttSubscription) bool { return s == sub })
+	t.mu.Unlock()
+
+	sub.messages.close()
+	for {
+		msg, ok := sub.messages.get()
+		if !ok {
+			return
+		}
+		t.dispatch(msg)
+	}
+}
+
+func (t *MQTTTransport) resolveSuback(payload []byte) {
+	if len(payload) < 2 {
+		return
+	}
+	id := binary.BigEndian.Uint16(payload)
+	codes := payload[2:]
+	if t.opts.Version == MQTT5 {
+		props, err := parseMQTTProperties(codes)
+		if err != nil {
+			t.resolve(id, err)
+			return
+		}
+		codes = codes[len(codes)-len(props.rest):]
+	}
+
+	switch {
+	case len(codes) == 0:
+		t.resolve(id, errors.New("SUBACK without a return code"))
+	case codes[0] >= 0x80:
+		t.resolve(id, fmt.Errorf("subscription refused by broker with code 0x%02x", codes[0]))
+	default:
+		t.resolve(id, nil)
+	}
+}
+
+func (t *MQTTTransport) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closed:
+			return
+		case <-ticker.C:
+			if err := t.writePacket(mqttPingreq<<4, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (t *MQTTTransport) writePacket(header byte, body []byte) error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	t.w.WriteByte(header)
+	t.w.Write(appendMQTTLength(nil, len(body)))
+	t.w.Write(body)
+	return t.w.Flush()
+}
+
+// appendMQTTPublish appends the variable header and payload of a QoS 1
+// PUBLISH packet.
+func appendMQTTPublish(b []byte, version byte, msg mqttPublish) []byte {
+	b = appendMQTTString(b, msg.topic)
+	b = binary.BigEndian.AppendUint16(b, msg.packetID)
+	if version == MQTT5 {
+		var props []byte
+		if msg.contentType != "" {
+			props = append(props, mqttContentType)
+			props = appendMQTTString(props, msg.contentType)
+		}
+		b = appendMQTTProperties(b, props)
+	}
+	return append(b, msg.payload...)
+}
+
+func parseMQTTPublish(header byte, payload []byte, version byte) (mqttPublish, error) {
+	if len(payload) < 2 {
+		return mqttPublish{}, errors.New("short PUBLISH packet")
+	}
+	n := int(binary.BigEndian.Uint16(payload))
+	payload = payload[2:]
+	if len(payload) < n {
+		return mqttPublish{}, errors.New("short PUBLISH topic")
+	}
+
+	msg := mqttPublish{topic: string(payload[:n])}
+	payload = payload[n:]
+
+	if qos := (header >> 1) & 0x03; qos > 0 {
+		if len(payload) < 2 {
+			return mqttPublish{}, errors.New("short PUBLISH packet id")
+		}
+		msg.packetID = binary.BigEndian.Uint16(payload)
+		payload = payload[2:]
+	}
+
+	if version == MQTT5 {
+		props, err := parseMQTTProperties(payload)
+		if err != nil {
+			return mqttPublish{}, fmt.Errorf("invalid PUBLISH properties: %v", err)
+		}
+		msg.contentType = props.contentType
+		payload = props.rest
+	}
+	msg.payload = payload
+	return msg, nil
+}
+
+// MQTT 5 property identifiers and reason codes the transport uses.
+const (
+	mqttContentType   = 0x03
+	mqttSessionExpiry = 0x11
+
+	mqttUnspecifiedError = 0x80
+)
+
+func appendMQTTProperties(b, props []byte) []byte {
+	b = appendMQTTLength(b, len(props))
+	return append(b, props...)
+}
+
+// mqttProperties is what the transport reads from an MQTT 5 property list.
+type mqttProperties struct {
+	contentType string
+	// rest is what follows the property list.
+	rest []byte
+}
+
+// parseMQTTProperties reads the property list at the start of b. Properties
+// other than the content type are skipped by the size of their type.
+func parseMQTTProperties(b []byte) (mqttProperties, error) {
+	length, n, err := parseMQTTLength(b)
+	if err != nil {
+		return mqttProperties{}, err
+	}
+	b = b[n:]
+	if len(b) < length {
+		return mqttProperties{}, errors.New("short property list")
+	}
+	props := mqttProperties{rest: b[length:]}
+	b = b[:length]
+
+	// stringSize is the size of a length-prefixed string or binary value.
+	stringSize := func(b []byte) int {
+		if len(b) < 2 {
+			return len(b) + 1
+		}
+		return 2 + int(binary.BigEndian.Uint16(b))
+	}
+
+	for len(b) > 0 {
+		id := b[0]
+		b = b[1:]
+
+		size := 0
+		switch id {
+		case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2a:
+			size = 1
+		case 0x13, 0x21, 0x22, 0x23:
+			size = 2
+		case 0x02, 0x11, 0x18, 0x27:
+			size = 4
+		case 0x0b:
+			_, size, err = parseMQTTLength(b)
+			if err != nil {
+				return mqttProperties{}, err
+			}
+		case mqttContentType, 0x08, 0x09, 0x12, 0x15, 0x16, 0x1a, 0x1c, 0x1f:
+			size = stringSize(b)
+		case 0x26:
+			// A user property is a pair of strings.
+			size = stringSize(b)
+			if size <= len(b) {
+				size += stringSize(b[size:])
+			}
+		default:
+			return mqttProperties{}, fmt.Errorf("unknown property 0x%02x", id)
+		}
+		if size > len(b) {
+			return mqttProperties{}, fmt.Errorf("short property 0x%02x", id)
+		}
+
+		if id == mqttContentType {
+			props.contentType = string(b[2:size])
+		}
+		b = b[size:]
+	}
+	return props, nil
+}
+
+// parseMQTTLength reads a variable byte integer, returning it and its size.
+func parseMQTTLength(b []byte) (int, int, error) {
+	length, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		if i >= len(b) {
+			return 0, 0, errors.New("short variable byte integer")
+		}
+		length += int(b[i]&0x7f) * multiplier
+		multiplier *= 128
+		if b[i]&0x80 == 0 {
+			return length, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("malformed variable byte integer")
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed mqtt remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header, payload, nil
+}
+
+func appendMQTTLength(b []byte, length int) []byte {
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			return b
+		}
+	}
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,762 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mqttBroker is an embedded MQTT broker for one client at a time. It speaks
+// whichever of MQTT 3.1.1 and 5 the client connects with, routes QoS 1
+// publishes to the client's own subscriptions and records the client's
+// PUBACKs. It encodes and decodes packets itself rather than with the
+// transport's code, so a framing bug can't pass on both sides.
+type mqttBroker struct {
+	// refuse, when set, is the code the broker refuses connections with.
+	refuse byte
+
+	addr    string
+	pubacks chan clientPuback
+
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	conn    net.Conn
+	version byte
+	filters []string
+	// refused are filters the broker refuses subscriptions to.
+	refused []string
+	nextID  uint16
+}
+
+// clientPuback is a PUBACK the client sent, with its reason code.
+type clientPuback struct {
+	packetID uint16
+	reason   byte
+}
+
+func startMQTTBroker(t *testing.T, refuse byte) *mqttBroker {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	b := &mqttBroker{refuse: refuse, addr: l.Addr().String(), pubacks: make(chan clientPuback, 100)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+// refuseFilter makes the broker refuse subscriptions to filter.
+func (b *mqttBroker) refuseFilter(filter string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refused = append(b.refused, filter)
+}
+
+func (b *mqttBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// CONNECT starts with the protocol name, "MQTT", and level.
+	header, body, err := brokerRead(r)
+	if err != nil || header != 0x10 || len(body) < 7 || string(body[2:6]) != "MQTT" {
+		return
+	}
+	b.mu.Lock()
+	b.conn = conn
+	b.version = body[6]
+	b.filters = nil
+	b.mu.Unlock()
+
+	connack := []byte{0, b.refuse}
+	if b.version == 5 {
+		connack = append(connack, 0)
+	}
+	b.write(0x20, connack)
+	if b.refuse != 0 {
+		return
+	}
+
+	for {
+		header, body, err := brokerRead(r)
+		if err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 8: // SUBSCRIBE
+			id, rest := body[:2], body[2:]
+			if b.version == 5 {
+				rest = brokerSkipProperties(rest)
+			}
+			n := int(rest[0])<<8 | int(rest[1])
+			filter := string(rest[2 : 2+n])
+
+			code := byte(1)
+			b.mu.Lock()
+			if slices.Contains(b.refused, filter) {
+				code = 0x80
+			} else {
+				b.filters = append(b.filters, filter)
+			}
+			b.mu.Unlock()
+
+			suback := slices.Clone(id)
+			if b.version == 5 {
+				suback = append(suback, 0)
+			}
+			b.write(0x90, append(suback, code))
+
+		case 3: // PUBLISH, always QoS 1 from the transport
+			n := int(body[0])<<8 | int(body[1])
+			topic := string(body[2 : 2+n])
+			id, rest := body[2+n:4+n], body[4+n:]
+			contentType := ""
+			if b.version == 5 {
+				contentType, rest = brokerContentType(rest)
+			}
+			b.write(0x40, id)
+			b.deliver(topic, contentType, rest)
+
+		case 4: // PUBACK
+			ack := clientPuback{packetID: uint16(body[0])<<8 | uint16(body[1])}
+			if len(body) > 2 {
+				ack.reason = body[2]
+			}
+			b.pubacks <- ack
+
+		case 12: // PINGREQ
+			b.write(0xd0, nil)
+
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// brokerRead reads a packet: a header byte, the remaining length as a
+// variable byte integer, and that many bytes.
+func brokerRead(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := brokerVarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// brokerVarint reads seven bits a byte, least significant first, while the
+// top bit is set.
+func brokerVarint(r io.ByteReader) (int, error) {
+	n := 0
+	for shift := 0; shift < 28; shift += 7 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n |= int(c&0x7f) << shift
+		if c < 0x80 {
+			return n, nil
+		}
+	}
+	return 0, errors.New("variable byte integer too long")
+}
+
+func brokerSkipProperties(b []byte) []byte {
+	r := bytes.NewReader(b)
+	n, err := brokerVarint(r)
+	if err != nil {
+		return nil
+	}
+	return b[len(b)-r.Len()+n:]
+}
+
+// brokerContentType reads the property list the transport sends with a
+// PUBLISH, which holds at most a content type, and returns what follows.
+func brokerContentType(b []byte) (string, []byte) {
+	r := bytes.NewReader(b)
+	n, err := brokerVarint(r)
+	if err != nil {
+		return "", nil
+	}
+	props, rest := b[len(b)-r.Len():][:n], b[len(b)-r.Len()+n:]
+	if len(props) < 3 || props[0] != 0x03 {
+		return "", rest
+	}
+	size := int(props[1])<<8 | int(props[2])
+	return string(props[3 : 3+size]), rest
+}
+
+func brokerString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func (b *mqttBroker) write(header byte, body []byte) {
+	packet := []byte{header}
+	for n := len(body); ; n >>= 7 {
+		if n < 0x80 {
+			packet = append(packet, byte(n))
+			break
+		}
+		packet = append(packet, byte(n&0x7f)|0x80)
+	}
+
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+	conn.Write(append(packet, body...))
+}
+
+// deliver sends a message to the client when it subscribed to topic.
+func (b *mqttBroker) deliver(topic, contentType string, payload []byte) {
+	b.mu.Lock()
+	matched := slices.ContainsFunc(b.filters, func(filter string) bool { return brokerMatches(filter, topic) })
+	b.mu.Unlock()
+	if matched {
+		b.send(topic, contentType, payload)
+	}
+}
+
+// send sends a QoS 1 message to the client whether or not it subscribed,
+// and returns its packet ID.
+func (b *mqttBroker) send(topic, contentType string, payload []byte) uint16 {
+	b.mu.Lock()
+	b.nextID++
+	id, version := b.nextID, b.version
+	b.mu.Unlock()
+
+	body := append(brokerString(topic), byte(id>>8), byte(id))
+	if version == 5 {
+		var props []byte
+		if contentType != "" {
+			props = append([]byte{0x03}, brokerString(contentType)...)
+		}
+		// Short property lists only.
+		body = append(append(body, byte(len(props))), props...)
+	}
+	b.write(0x32, append(body, payload...))
+	return id
+}
+
+func brokerMatches(filter, topic string) bool {
+	if prefix, ok := strings.CutSuffix(filter, "/#"); ok {
+		return topic == prefix || strings.HasPrefix(topic, prefix+"/")
+	}
+	filterLevels, topicLevels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if len(filterLevels) != len(topicLevels) {
+		return false
+	}
+	for i, level := range filterLevels {
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// puback returns the next PUBACK the client sent.
+func (b *mqttBroker) puback(t *testing.T) clientPuback {
+	t.Helper()
+	select {
+	case ack := <-b.pubacks:
+		return ack
+	case <-time.After(5 * time.Second):
+		t.Fatal("no PUBACK from the client")
+		return clientPuback{}
+	}
+}
+
+func dialTestMQTT(t *testing.T, b *mqttBroker, opts MQTTOptions) *MQTTTransport {
+	t.Helper()
+	opts.ClientID = "peril-test"
+	opts.CleanSession = true
+	client, err := DialMQTT(b.addr, "peril_topic", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+var mqttVersions = []struct {
+	name    string
+	version byte
+}{
+	{"3.1.1", MQTT311},
+	{"5", MQTT5},
+}
+
+func TestMQTTTransportRoundTrip(t *testing.T) {
+	for _, v := range mqttVersions {
+		t.Run(v.name, func(t *testing.T) {
+			broker := startMQTTBroker(t, 0)
+			client := dialTestMQTT(t, broker, MQTTOptions{Version: v.version})
+
+			got := make(chan Envelope, 1)
+			err := client.Subscribe("peril_topic", "", "army_moves.*", Transient, func(env Envelope) Acktype {
+				got <- env
+				return Ack
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = client.Publish("peril_topic", "army_moves.alice", Envelope{ContentType: "application/json", Body: []byte(`{}`)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Only MQTT 5 carries the content type.
+			wantType := ""
+			if v.version == MQTT5 {
+				wantType = "application/json"
+			}
+			env := <-got
+			if env.RoutingKey != "army_moves.alice" || env.ContentType != wantType || string(env.Body) != "{}" {
+				t.Errorf("handler got %+v", env)
+			}
+			if ack := broker.puback(t); ack.reason != 0 {
+				t.Errorf("PUBACK reason 0x%02x, want 0", ack.reason)
+			}
+		})
+	}
+}
+
+// A handler publishing at QoS 1 needs the read loop to keep reading PUBACKs
+// while more messages than any buffer holds are waiting for the handler.
+func TestMQTTHandlerMayPublish(t *testing.T) {
+	for _, v := range mqttVersions {
+		t.Run(v.name, func(t *testing.T) {
+			broker := startMQTTBroker(t, 0)
+			client := dialTestMQTT(t, broker, MQTTOptions{Version: v.version})
+
+			err := client.Subscribe("peril_topic", "", "army_moves.*", Transient, func(env Envelope) Acktype {
+				if err := client.Publish("peril_topic", "battles.test", env); err != nil {
+					t.Error(err)
+					return NackDiscard
+				}
+				return Ack
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const n = 50
+			for i := range n {
+				broker.deliver("army_moves/test", "", []byte(strconv.Itoa(i)))
+			}
+			for range n {
+				if ack := broker.puback(t); ack.reason != 0 {
+					t.Errorf("PUBACK reason 0x%02x, want 0", ack.reason)
+				}
+			}
+		})
+	}
+}
+
+func TestMQTTNackRequeue(t *testing.T) {
+	tests := []struct {
+		name    string
+		version byte
+		// nacks is how often the handler requeues before acking.
+		nacks      int
+		wantCalls  int
+		wantReason byte
+	}{
+		{"redelivered until acked", MQTT5, 2, 3, 0},
+		{"discarded after max requeues", MQTT5, 10, 4, mqttUnspecifiedError},
+		{"discarded after max requeues 3.1.1", MQTT311, 10, 4, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := startMQTTBroker(t, 0)
+			client := dialTestMQTT(t, broker, MQTTOptions{
+				Version:      tt.version,
+				RequeueDelay: time.Millisecond,
+				MaxRequeues:  3,
+			})
+
+			var mu sync.Mutex
+			calls := 0
+			err := client.Subscribe("peril_topic", "", "army_moves.*", Transient, func(Envelope) Acktype {
+				mu.Lock()
+				defer mu.Unlock()
+				calls++
+				if calls <= tt.nacks {
+					return NackRequeue
+				}
+				return Ack
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			broker.deliver("army_moves/test", "", []byte("{}"))
+			ack := broker.puback(t)
+			if ack.reason != tt.wantReason {
+				t.Errorf("PUBACK reason 0x%02x, want 0x%02x", ack.reason, tt.wantReason)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if calls != tt.wantCalls {
+				t.Errorf("handler called %d times, want %d", calls, tt.wantCalls)
+			}
+			select {
+			case extra := <-broker.pubacks:
+				t.Errorf("unexpected second PUBACK %+v", extra)
+			default:
+			}
+		})
+	}
+}
+
+func TestMQTTConnectRefused(t *testing.T) {
+	for _, v := range mqttVersions {
+		t.Run(v.name, func(t *testing.T) {
+			// 0x05 is "not authorized" in 3.1.1, 0x87 in 5.
+			code := byte(0x05)
+			if v.version == MQTT5 {
+				code = 0x87
+			}
+			broker := startMQTTBroker(t, code)
+
+			_, err := DialMQTT(broker.addr, "peril_topic", MQTTOptions{ClientID: "peril-test", Version: v.version})
+			if err == nil {
+				t.Fatal("connect succeeded, want refused")
+			}
+		})
+	}
+}
+
+func TestParseMQTTProperties(t *testing.T) {
+	tests := []struct {
+		name string
+		// props is a property list, with its length first.
+		props       string
+		contentType string
+		wantErr     bool
+	}{
+		{"empty", "\x00", "", false},
+		{"content type", "\x12\x03\x00\x0fapplication/gob", "application/gob", false},
+		{
+			// A payload format indicator, message expiry, subscription
+			// identifier 129 and the user property k=v come first.
+			"content type after others",
+			"\x24\x01\x01\x02\x00\x00\x00\x3c\x0b\x81\x01\x26\x00\x01k\x00\x01v\x03\x00\x10application/json",
+			"application/json",
+			false,
+		},
+		{"unknown property", "\x02\x7f\x01", "", true},
+		{"short property", "\x03\x02\x00\x00", "", true},
+		{"short list", "\x09\x01\x01", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			props, err := parseMQTTProperties([]byte(tt.props + "payload"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if props.contentType != tt.contentType || string(props.rest) != "payload" {
+				t.Errorf("got %q and rest %q", props.contentType, props.rest)
+			}
+		})
+	}
+}
+
+func TestReadMQTTPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		header  byte
+		length  int
+		wantErr bool
+	}{
+		{"no body", "\xd0\x00", 0xd0, 0, false},
+		{"one length byte", "\x40\x02\x00\x07", 0x40, 2, false},
+		{"two length bytes", "\x30\x80\x01" + strings.Repeat("x", 128), 0x30, 128, false},
+		{"length too long", "\x30\xff\xff\xff\xff\x01", 0, 0, true},
+		{"short body", "\x30\x05ab", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, body, err := readMQTTPacket(bufio.NewReader(strings.NewReader(tt.in)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (header != tt.header || len(body) != tt.length) {
+				t.Errorf("got header 0x%02x and %d bytes, want 0x%02x and %d", header, len(body), tt.header, tt.length)
+			}
+		})
+	}
+}
+
+func TestAppendMQTTLength(t *testing.T) {
+	tests := []struct {
+		length int
+		want   string
+	}{
+		{0, "\x00"},
+		{127, "\x7f"},
+		{128, "\x80\x01"},
+		{16383, "\xff\x7f"},
+		{16384, "\x80\x80\x01"},
+	}
+
+	for _, tt := range tests {
+		if got := appendMQTTLength(nil, tt.length); string(got) != tt.want {
+			t.Errorf("appendMQTTLength(%d) = % x, want % x", tt.length, got, tt.want)
+		}
+	}
+}
+
+// TestMQTTWireFormat compares what the client writes with packets written
+// out by hand, and feeds it hand-written packets.
+func TestMQTTWireFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		version byte
+		// The client connects as c, subscribes to army_moves.*, publishes
+		// {} as JSON to army_moves.alice and is sent hi on army_moves.bob,
+		// as text/plain when the version carries content types.
+		connect, connack      string
+		subscribe, suback     string
+		publish, puback       string
+		delivery, contentType string
+	}{
+		{
+			name:        "3.1.1",
+			version:     MQTT311,
+			connect:     "\x10\x0d\x00\x04MQTT\x04\x02\x00\x1e\x00\x01c",
+			connack:     "\x20\x02\x00\x00",
+			subscribe:   "\x82\x11\x00\x01\x00\x0carmy_moves/+\x01",
+			suback:      "\x90\x03\x00\x01\x01",
+			publish:     "\x32\x16\x00\x10army_moves/alice\x00\x02{}",
+			puback:      "\x40\x02\x00\x02",
+			delivery:    "\x32\x14\x00\x0earmy_moves/bob\x00\x07hi",
+			contentType: "",
+		},
+		{
+			name:        "5",
+			version:     MQTT5,
+			connect:     "\x10\x0e\x00\x04MQTT\x05\x02\x00\x1e\x00\x00\x01c",
+			connack:     "\x20\x03\x00\x00\x00",
+			subscribe:   "\x82\x12\x00\x01\x00\x00\x0carmy_moves/+\x01",
+			suback:      "\x90\x04\x00\x01\x00\x01",
+			publish:     "\x32\x2a\x00\x10army_moves/alice\x00\x02\x13\x03\x00\x10application/json{}",
+			puback:      "\x40\x03\x00\x02\x00",
+			delivery:    "\x32\x22\x00\x0earmy_moves/bob\x00\x07\x0d\x03\x00\x0atext/plainhi",
+			contentType: "text/plain",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			type dialed struct {
+				client *MQTTTransport
+				err    error
+			}
+			dials := make(chan dialed, 1)
+			go func() {
+				client, err := DialMQTT(l.Addr().String(), "peril_topic", MQTTOptions{ClientID: "c", Version: tt.version, CleanSession: true})
+				dials <- dialed{client, err}
+			}()
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			expect := func(what, want string) {
+				t.Helper()
+				got := make([]byte, len(want))
+				if _, err := io.ReadFull(conn, got); err != nil {
+					t.Fatalf("could not read %s: %v", what, err)
+				}
+				if string(got) != want {
+					t.Fatalf("%s is % x, want % x", what, got, want)
+				}
+			}
+			send := func(packet string) {
+				t.Helper()
+				if _, err := conn.Write([]byte(packet)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expect("CONNECT", tt.connect)
+			send(tt.connack)
+			d := <-dials
+			if d.err != nil {
+				t.Fatal(d.err)
+			}
+			defer d.client.Close()
+
+			got := make(chan Envelope, 1)
+			errs := make(chan error, 1)
+			go func() {
+				errs <- d.client.Subscribe("peril_topic", "", "army_moves.*", Transient, func(env Envelope) Acktype {
+					got <- env
+					return Ack
+				})
+			}()
+			expect("SUBSCRIBE", tt.subscribe)
+			send(tt.suback)
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+
+			go func() {
+				errs <- d.client.Publish("peril_topic", "army_moves.alice", Envelope{ContentType: "application/json", Body: []byte("{}")})
+			}()
+			expect("PUBLISH", tt.publish)
+			send(tt.puback)
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+
+			send(tt.delivery)
+			env := <-got
+			if env.RoutingKey != "army_moves.bob" || env.ContentType != tt.contentType || string(env.Body) != "hi" {
+				t.Errorf("handler got %+v", env)
+			}
+			expect("PUBACK", "\x40\x02\x00\x07")
+		})
+	}
+}
+
+func TestMQTTUnmatchedMessageIsDiscarded(t *testing.T) {
+	tests := []struct {
+		name       string
+		version    byte
+		wantReason byte
+	}{
+		{"3.1.1", MQTT311, 0},
+		{"5", MQTT5, mqttUnspecifiedError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := startMQTTBroker(t, 0)
+			client := dialTestMQTT(t, broker, MQTTOptions{Version: tt.version})
+			err := client.Subscribe("peril_topic", "", "army_moves.*", Transient, func(Envelope) Acktype {
+				t.Error("handler called for another topic")
+				return Ack
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id := broker.send("pause", "", []byte("{}"))
+			ack := broker.puback(t)
+			if ack.packetID != id || ack.reason != tt.wantReason {
+				t.Errorf("PUBACK %+v, want packet %d with reason 0x%02x", ack, id, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestMQTTRefusedSubscription(t *testing.T) {
+	broker := startMQTTBroker(t, 0)
+	broker.refuseFilter("army_moves/+")
+	client := dialTestMQTT(t, broker, MQTTOptions{Version: MQTT5})
+
+	err := client.Subscribe("peril_topic", "", "army_moves.*", Transient, func(Envelope) Acktype {
+		t.Error("handler of a refused subscription called")
+		return Ack
+	})
+	if err == nil {
+		t.Fatal("Subscribe succeeded, want refused")
+	}
+
+	// The refused subscription no longer receives, so the message is
+	// discarded rather than left unacknowledged.
+	id := broker.send("army_moves/alice", "", []byte("{}"))
+	if ack := broker.puback(t); ack.packetID != id || ack.reason != mqttUnspecifiedError {
+		t.Errorf("PUBACK %+v, want packet %d discarded", ack, id)
+	}
+}
+
+func TestMQTTTopicTranslation(t *testing.T) {
+	tests := []struct {
+		key   string
+		topic string
+	}{
+		{"army_moves.alice", "army_moves/alice"},
+		{"army_moves.*", "army_moves/+"},
+		{"game_logs.#", "game_logs/#"},
+		{"pause", "pause"},
+		{"a/b.c", "a.b/c"},
+	}
+
+	for _, tt := range tests {
+		if got := AMQPKeyToMQTTTopic(tt.key); got != tt.topic {
+			t.Errorf("AMQPKeyToMQTTTopic(%q) = %q, want %q", tt.key, got, tt.topic)
+		}
+		if got := MQTTTopicToAMQPKey(tt.topic); got != tt.key {
+			t.Errorf("MQTTTopicToAMQPKey(%q) = %q, want %q", tt.topic, got, tt.key)
+		}
+	}
+}
+
+func TestMQTTTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"army_moves/+", "army_moves/alice", true},
+		{"army_moves/+", "army_moves", false},
+		{"army_moves/+", "army_moves/alice/bob", false},
+		{"game_logs/#", "game_logs/alice", true},
+		{"game_logs/#", "game_logs/a/b", true},
+		{"pause", "pause", true},
+		{"pause", "ruleset", false},
+	}
+
+	for _, tt := range tests {
+		if got := mqttTopicMatches(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("mqttTopicMatches(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
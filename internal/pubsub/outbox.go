@@ -0,0 +1,394 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Outbox makes publishes survive a broker outage. Messages are appended to a
+// local log file before they are published, and a background relay drains the
+// log with publisher confirms, retrying until the broker accepts each message.
+// Messages with the same routing key are always published in the order they
+// were enqueued.
+//
+// The relay keeps a broker connection of its own, dialed with the function
+// given to OpenOutbox, and dials again with the relay's backoff whenever it
+// is lost.
+type Outbox struct {
+	path string
+	dial func() (*amqp.Connection, error)
+
+	mu      sync.Mutex
+	f       *os.File
+	nextSeq uint64
+	pending []OutboxEntry
+
+	// drainMu serializes relay attempts and guards the connection and its
+	// confirm channel.
+	drainMu sync.Mutex
+	conn    *amqp.Connection
+	ch      *amqp.Channel
+
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type OutboxEntry struct {
+	Seq         uint64
+	Exchange    string
+	Key         string
+	ContentType string
+	Headers     map[string]any `json:",omitempty"`
+	Body        []byte
+	EnqueuedAt  time.Time
+	Attempts    int    `json:"-"`
+	LastError   string `json:"-"`
+}
+
+// outboxRecord is one line of the outbox log: either a new entry or the
+// confirmation that an entry was published.
+type outboxRecord struct {
+	Entry *OutboxEntry `json:",omitempty"`
+	Acked uint64       `json:",omitempty"`
+}
+
+const (
+	outboxMinBackoff = 500 * time.Millisecond
+	outboxMaxBackoff = 30 * time.Second
+	outboxConfirm    = 5 * time.Second
+)
+
+// OpenOutbox loads the outbox log at path, keeping any entries that were not
+// confirmed before the last shutdown, and starts the relay. The relay connects
+// with dial when it first publishes, so the outbox opens while the broker is
+// down too.
+func OpenOutbox(path string, dial func() (*amqp.Connection, error)) (*Outbox, error) {
+	o := &Outbox{
+		path:    path,
+		dial:    dial,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	err := o.load()
+	if err != nil {
+		return nil, fmt.Errorf("could not load outbox %s: %v", path, err)
+	}
+
+	err = o.compact()
+	if err != nil {
+		return nil, fmt.Errorf("could not compact outbox %s: %v", path, err)
+	}
+
+	go o.relay()
+	o.notify()
+
+	return o, nil
+}
+
+func (o *Outbox) load() error {
+	f, err := os.Open(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries := map[uint64]OutboxEntry{}
+	order := []uint64{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var rec outboxRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A torn write at the end of the file is the only expected
+			// corruption; everything before it is still valid.
+			log.Printf("Ignoring corrupt outbox record: %v\n", err)
+			break
+		}
+		if rec.Entry != nil {
+			entries[rec.Entry.Seq] = *rec.Entry
+			order = append(order, rec.Entry.Seq)
+			o.nextSeq = max(o.nextSeq, rec.Entry.Seq)
+		}
+		if rec.Acked != 0 {
+			delete(entries, rec.Acked)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, seq := range order {
+		if entry, ok := entries[seq]; ok {
+			o.pending = append(o.pending, entry)
+		}
+	}
+	return nil
+}
+
+// compact rewrites the log so it only holds pending entries. Callers must
+// hold o.mu or own o exclusively.
+func (o *Outbox) compact() error {
+	tmp := o.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	for i := range o.pending {
+		if err := enc.Encode(outboxRecord{Entry: &o.pending[i]}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, o.path); err != nil {
+		return err
+	}
+
+	if o.f != nil {
+		o.f.Close()
+	}
+	o.f, err = os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0644)
+	return err
+}
+
+func (o *Outbox) write(rec outboxRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = o.f.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return o.f.Sync()
+}
+
+// Enqueue durably records a message and schedules it for publishing.
+func (o *Outbox) Enqueue(exchange, key, contentType string, headers map[string]any, body []byte) (uint64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entry := OutboxEntry{
+		Seq:         o.nextSeq + 1,
+		Exchange:    exchange,
+		Key:         key,
+		ContentType: contentType,
+		Headers:     headers,
+		Body:        body,
+		EnqueuedAt:  time.Now(),
+	}
+	if err := o.write(outboxRecord{Entry: &entry}); err != nil {
+		return 0, fmt.Errorf("could not write outbox entry: %v", err)
+	}
+	o.nextSeq = entry.Seq
+	o.pending = append(o.pending, entry)
+
+	o.notify()
+	return entry.Seq, nil
+}
+
+func EnqueueTopic[T any](o *Outbox, topic Topic[T], val T) error {
+	encoded, err := topic.Codec.Encode(val)
+	if err != nil {
+		return err
+	}
+
+	_, err = o.Enqueue(topic.Exchange, topic.Key(val), topic.Codec.ContentType(), topic.headers(val), encoded)
+	return err
+}
+
+// Pending returns the entries that have not been confirmed by the broker yet.
+func (o *Outbox) Pending() []OutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]OutboxEntry{}, o.pending...)
+}
+
+// Flush publishes pending entries right away instead of waiting for the relay's
+// next attempt. It returns an error if any entry is still pending afterwards.
+func (o *Outbox) Flush(ctx context.Context) error {
+	o.drain(ctx)
+
+	n := len(o.Pending())
+	if n > 0 {
+		return fmt.Errorf("%d message(s) still pending", n)
+	}
+	return nil
+}
+
+func (o *Outbox) Close() error {
+	close(o.done)
+	<-o.stopped
+
+	o.drainMu.Lock()
+	if o.ch != nil {
+		o.ch.Close()
+	}
+	if o.conn != nil {
+		o.conn.Close()
+	}
+	o.drainMu.Unlock()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.f.Close()
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *Outbox) relay() {
+	defer close(o.stopped)
+
+	backoff := outboxMinBackoff
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+	<-retry.C
+
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-o.wake:
+		case <-retry.C:
+		}
+
+		if o.drain(context.Background()) {
+			backoff = outboxMinBackoff
+			continue
+		}
+
+		retry.Reset(backoff)
+		backoff = min(backoff*2, outboxMaxBackoff)
+	}
+}
+
+// drain tries to publish every pending entry once and reports whether the
+// outbox is empty afterwards. When an entry fails, later entries with the same
+// routing key are held back so they can't overtake it.
+func (o *Outbox) drain(ctx context.Context) bool {
+	o.drainMu.Lock()
+	defer o.drainMu.Unlock()
+
+	batch := o.Pending()
+	blocked := map[string]bool{}
+	published := 0
+	for _, entry := range batch {
+		if blocked[entry.Exchange+" "+entry.Key] {
+			continue
+		}
+
+		err := o.publish(ctx, entry)
+		if err != nil {
+			blocked[entry.Exchange+" "+entry.Key] = true
+		}
+
+		o.mu.Lock()
+		for i := range o.pending {
+			if o.pending[i].Seq != entry.Seq {
+				continue
+			}
+			if err != nil {
+				o.pending[i].Attempts++
+				o.pending[i].LastError = err.Error()
+				break
+			}
+			if werr := o.write(outboxRecord{Acked: entry.Seq}); werr != nil {
+				log.Printf("Error recording outbox confirmation: %v\n", werr)
+			}
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			published++
+			break
+		}
+		o.mu.Unlock()
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) == 0 && published > 0 {
+		if err := o.compact(); err != nil {
+			log.Printf("Error compacting outbox: %v\n", err)
+		}
+	}
+	return len(o.pending) == 0
+}
+
+// publish sends one entry and waits for the broker to confirm it. Callers must
+// hold o.drainMu.
+func (o *Outbox) publish(ctx context.Context, entry OutboxEntry) error {
+	return guard(func() error {
+		return o.publishConfirmed(ctx, entry)
+	})
+}
+
+func (o *Outbox) publishConfirmed(ctx context.Context, entry OutboxEntry) error {
+	if o.conn == nil || o.conn.IsClosed() {
+		o.ch = nil
+		conn, err := o.dial()
+		if err != nil {
+			return fmt.Errorf("%w: %w", errDial, err)
+		}
+		o.conn = conn
+	}
+	if o.ch == nil || o.ch.IsClosed() {
+		ch, err := o.conn.Channel()
+		if err != nil {
+			return err
+		}
+		if err := ch.Confirm(false); err != nil {
+			ch.Close()
+			return err
+		}
+		o.ch = ch
+	}
+
+	confirm, err := o.ch.PublishWithDeferredConfirmWithContext(ctx, entry.Exchange, entry.Key, false, false, amqp.Publishing{
+		Headers:      amqp.Table(entry.Headers),
+		ContentType:  entry.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    entry.EnqueuedAt,
+		Body:         entry.Body,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, outboxConfirm)
+	defer cancel()
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("broker nacked the message")
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// withBreaker swaps DefaultBreaker for the duration of a test.
+func withBreaker(t *testing.T, b *Breaker) {
+	old := DefaultBreaker
+	DefaultBreaker = b
+	t.Cleanup(func() { DefaultBreaker = old })
+}
+
+func TestOutboxRedialsWhileBrokerDown(t *testing.T) {
+	// Keep the breaker closed, so every attempt reaches the dial function.
+	withBreaker(t, NewBreaker(BreakerOptions{MinRequests: 1 << 30}))
+
+	var dials atomic.Int32
+	dial := func() (*amqp.Connection, error) {
+		dials.Add(1)
+		return nil, errors.New("connection refused")
+	}
+
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o, err := OpenOutbox(path, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"army_moves.alice", "army_moves.alice", "spawns.alice"}
+	for _, key := range keys {
+		if _, err := o.Enqueue("peril_topic", key, "application/json", nil, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for range 2 {
+		if err := o.Flush(context.Background()); err == nil {
+			t.Fatal("Flush succeeded without a broker")
+		}
+	}
+	// Each flush dials again for the first entry of every routing key.
+	if n := dials.Load(); n < 4 {
+		t.Errorf("dialed %d times, want at least 4", n)
+	}
+
+	pending := o.Pending()
+	if len(pending) != len(keys) {
+		t.Fatalf("%d pending entries, want %d", len(pending), len(keys))
+	}
+	if !strings.Contains(pending[0].LastError, "could not connect") {
+		t.Errorf("last error %q, want a connection error", pending[0].LastError)
+	}
+	// The second alice move is held back behind the first.
+	if pending[1].Attempts != 0 {
+		t.Errorf("second entry attempted %d times, want 0", pending[1].Attempts)
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenOutbox(path, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	pending = reopened.Pending()
+	if len(pending) != len(keys) {
+		t.Fatalf("%d pending entries after reopening, want %d", len(pending), len(keys))
+	}
+	for i, entry := range pending {
+		if entry.Seq != uint64(i+1) || entry.Key != keys[i] {
+			t.Errorf("entry %d is %d %s, want %d %s", i, entry.Seq, entry.Key, i+1, keys[i])
+		}
+	}
+}
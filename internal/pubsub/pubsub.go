@@ -1,12 +1,7 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
-	"fmt"
-	"log"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -27,29 +22,28 @@ const (
 )
 
 func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	encoded, err := json.Marshal(val)
-	if err != nil {
-		return err
-	}
-
-	ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/json",
-		Body:        encoded,
-	})
-
-	return nil
+	return publish(ch, exchange, key, JSON, nil, val)
 }
 
 func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	var b bytes.Buffer
-	err := gob.NewEncoder(&b).Encode(val)
+	return publish(ch, exchange, key, Gob, nil, val)
+}
+
+func publish(ch *amqp.Channel, exchange, key string, codec Codec, headers amqp.Table, val any) error {
+	encoded, err := codec.Encode(val)
 	if err != nil {
 		return err
 	}
 
-	err = ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/gob",
-		Body:        b.Bytes(),
+	err = guard(func() error {
+		return ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
+			Headers:     headers,
+			ContentType: codec.ContentType(),
+			// Lets a consumer that also reads a stream tell which messages
+			// it already has.
+			MessageId: newID(),
+			Body:      encoded,
+		})
 	})
 	if err != nil {
 		return err
@@ -64,22 +58,30 @@ func DeclareAndBind(
 	queueName,
 	key string,
 	queueType simpleQueueType,
+) (*amqp.Channel, amqp.Queue, error) {
+	var ch *amqp.Channel
+	var queue amqp.Queue
+	err := guard(func() error {
+		var err error
+		ch, queue, err = declareAndBind(conn, exchange, queueName, key, queueType)
+		return err
+	})
+	return ch, queue, err
+}
+
+func declareAndBind(
+	conn *amqp.Connection,
+	exchange,
+	queueName,
+	key string,
+	queueType simpleQueueType,
 ) (*amqp.Channel, amqp.Queue, error) {
 	ch, err := conn.Channel()
 	if err != nil {
 		return nil, amqp.Queue{}, err
 	}
 
-	table := make(amqp.Table)
-	table["x-dead-letter-exchange"] = "peril_dlx"
-	queue, err := ch.QueueDeclare(
-		queueName,
-		queueType == Durable,
-		queueType == Transient,
-		queueType == Transient,
-		false,
-		table,
-	)
+	queue, err := declareQueue(ch, queueName, queueType)
 	if err != nil {
 		return nil, amqp.Queue{}, err
 	}
@@ -92,6 +94,19 @@ func DeclareAndBind(
 	return ch, queue, nil
 }
 
+func declareQueue(ch *amqp.Channel, queueName string, queueType simpleQueueType) (amqp.Queue, error) {
+	table := make(amqp.Table)
+	table["x-dead-letter-exchange"] = deadLetterExchange
+	return ch.QueueDeclare(
+		queueName,
+		queueType == Durable,
+		queueType == Transient,
+		queueType == Transient,
+		false,
+		table,
+	)
+}
+
 func SubscribeJSON[T any](
 	conn *amqp.Connection,
 	exchange,
@@ -100,45 +115,7 @@ func SubscribeJSON[T any](
 	queueType simpleQueueType,
 	handler func(T) Acktype,
 ) error {
-	ch, queue, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
-	if err != nil {
-		return fmt.Errorf("could not subscribe to pause: %v", err)
-	}
-	fmt.Printf("Queue %v declared and bound!\n", queue.Name)
-
-	deliveryCh, err := ch.Consume(queueName, "", false, false, false, false, nil)
-	if err != nil {
-		return err
-	}
-
-	go func() {
-		for delivery := range deliveryCh {
-			var val T
-			if err := json.Unmarshal(delivery.Body, &val); err != nil {
-				fmt.Printf("Error unmarshalling message: %v\n", err)
-				continue
-			}
-
-			ackt := handler(val)
-			switch ackt {
-			case Ack:
-				log.Println("Ack handled")
-				delivery.Ack(false)
-			case NackRequeue:
-				log.Println("Nack with requeue handled")
-				delivery.Nack(false, true)
-			case NackDiscard:
-				log.Println("Nack with discard handled")
-				delivery.Nack(false, false)
-			}
-
-			if err := delivery.Ack(false); err != nil {
-				fmt.Printf("Error acknowledging message: %v\n", err)
-			}
-		}
-	}()
-
-	return nil
+	return subscribe(conn, exchange, queueName, key, queueType, JSON, handler)
 }
 
 func SubscribeGob[T any](
@@ -149,45 +126,26 @@ func SubscribeGob[T any](
 	queueType simpleQueueType,
 	handler func(T) Acktype,
 ) error {
-	ch, queue, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
-	if err != nil {
-		return fmt.Errorf("could not subscribe to pause: %v", err)
-	}
-	fmt.Printf("Queue %v declared and bound!\n", queue.Name)
-
-	err = ch.Qos(10, 0, true)
-	if err != nil {
-		return err
-	}
-
-	deliveryCh, err := ch.Consume(queueName, "", false, false, false, false, nil)
-	if err != nil {
-		return err
-	}
-
-	go func() {
-		for message := range deliveryCh {
-			var val T
-			reader := bytes.NewReader(message.Body)
-			if err := gob.NewDecoder(reader).Decode(&val); err != nil {
-				fmt.Printf("Error decoding message: %v\n", err)
-				continue
-			}
-
-			ackt := handler(val)
-			switch ackt {
-			case Ack:
-				log.Println("Ack handled")
-				message.Ack(false)
-			case NackRequeue:
-				log.Println("Nack with requeue handled")
-				message.Nack(false, true)
-			case NackDiscard:
-				log.Println("Nack with discard handled")
-				message.Nack(false, false)
-			}
-		}
-	}()
+	return subscribe(conn, exchange, queueName, key, queueType, Gob, handler)
+}
 
-	return nil
+func subscribe[T any](
+	conn *amqp.Connection,
+	exchange,
+	queueName,
+	key string,
+	queueType simpleQueueType,
+	codec Codec,
+	handler func(T) Acktype,
+) error {
+	_, err := consume(
+		context.Background(),
+		conn,
+		queueName,
+		bindKey(conn, exchange, queueName, key, queueType),
+		codec,
+		Adapt(handler),
+		SubscribeOptions{},
+	)
+	return err
 }
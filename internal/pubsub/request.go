@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrNoReply means nobody answered a Request in time.
+var ErrNoReply = errors.New("no reply")
+
+// Request publishes val on topic with a private reply queue and waits for
+// the first reply, which is decoded with the topic's codec. It returns
+// ErrNoReply when nobody answered within wait. Subscribers answer with
+// Respond.
+func Request[T, R any](
+	ctx context.Context,
+	conn *amqp.Connection,
+	topic Topic[T],
+	val T,
+	wait time.Duration,
+) (R, error) {
+	var resp R
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return resp, err
+	}
+	defer ch.Close()
+
+	replies, correlationID, err := publishForReplies(ctx, ch, topic, val)
+	if err != nil {
+		return resp, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return resp, fmt.Errorf("%w from %s within %v", ErrNoReply, topic.Name, wait)
+			}
+			return resp, ctx.Err()
+		case delivery, ok := <-replies:
+			if !ok {
+				return resp, fmt.Errorf("reply queue for %s closed", topic.Name)
+			}
+			if delivery.CorrelationId != correlationID {
+				continue
+			}
+			err := decode(topic.Codec, delivery.ContentType, delivery.Body, &resp)
+			if err != nil {
+				return resp, fmt.Errorf("could not decode reply from %s: %v", topic.Name, err)
+			}
+			return resp, nil
+		}
+	}
+}
+
+// Respond answers a message published by Request, encoding resp with codec.
+// It does nothing for messages that did not ask for a reply.
+func Respond[T, R any](ch *amqp.Channel, msg Message[T], codec Codec, resp R) error {
+	if msg.ReplyTo == "" {
+		return nil
+	}
+
+	encoded, err := codec.Encode(resp)
+	if err != nil {
+		return err
+	}
+
+	return guard(func() error {
+		return ch.PublishWithContext(context.Background(), "", msg.ReplyTo, false, false, amqp.Publishing{
+			ContentType:   codec.ContentType(),
+			CorrelationId: msg.CorrelationID,
+			Body:          encoded,
+		})
+	})
+}
@@ -0,0 +1,114 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Retained messages work like MQTT retain: every routing key that should be
+// retained gets a durable max-length-1 queue bound next to the live queues, so
+// it always holds the latest message published under that key. New
+// subscribers peek at it before they start consuming.
+
+func RetainedQueueName(exchange, key string) string {
+	return "retained." + exchange + "." + key
+}
+
+func DeclareRetained(ch *amqp.Channel, exchange, key string) (amqp.Queue, error) {
+	var queue amqp.Queue
+	err := guard(func() error {
+		var err error
+		queue, err = declareRetained(ch, exchange, key)
+		return err
+	})
+	return queue, err
+}
+
+func declareRetained(ch *amqp.Channel, exchange, key string) (amqp.Queue, error) {
+	name := RetainedQueueName(exchange, key)
+	queue, err := ch.QueueDeclare(
+		name,
+		true,
+		false,
+		false,
+		false,
+		amqp.Table{
+			"x-max-length": 1,
+			"x-overflow":   "drop-head",
+		},
+	)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	err = ch.QueueBind(name, key, exchange, false, nil)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	return queue, nil
+}
+
+// GetRetained returns the latest retained value of topic without removing it.
+// Retained topics are published under a single key, their Pattern. The
+// boolean is false when nothing has been published yet.
+func GetRetained[T any](ch *amqp.Channel, topic Topic[T]) (T, bool, error) {
+	var val T
+
+	msg, ok, err := ch.Get(RetainedQueueName(topic.Exchange, topic.Pattern), false)
+	if err != nil || !ok {
+		return val, false, err
+	}
+	defer msg.Nack(false, true)
+
+	if err := decode(topic.Codec, msg.ContentType, msg.Body, &val); err != nil {
+		return val, false, fmt.Errorf("could not decode retained %s message: %v", topic.Name, err)
+	}
+
+	return val, true, nil
+}
+
+// SubscribeRetained behaves like SubscribeContext, but hands the retained
+// value of topic to the handler before any live message. The live queue is
+// bound first, so nothing published while the retained value is being read is
+// lost.
+func SubscribeRetained[T any](
+	ctx context.Context,
+	conn *amqp.Connection,
+	topic Topic[T],
+	queueName string,
+	queueType simpleQueueType,
+	handler Handler[T],
+	opts SubscribeOptions,
+) (*Subscription, error) {
+	ch, _, err := DeclareAndBind(conn, topic.Exchange, queueName, topic.Pattern, queueType)
+	if err != nil {
+		return nil, fmt.Errorf("could not declare %s: %v", queueName, err)
+	}
+	defer ch.Close()
+
+	_, err = DeclareRetained(ch, topic.Exchange, topic.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("could not declare retained queue for %s: %v", topic.Name, err)
+	}
+
+	val, ok, err := GetRetained(ch, topic)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		_, err := handler(ctx, Message[T]{
+			Body:       val,
+			Queue:      RetainedQueueName(topic.Exchange, topic.Pattern),
+			RoutingKey: topic.Pattern,
+		})
+		if err != nil {
+			log.Printf("Handler error on retained %s: %v\n", topic.Name, err)
+		}
+	}
+
+	return SubscribeContext(ctx, conn, topic, queueName, queueType, handler, opts)
+}
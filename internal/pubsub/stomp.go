@@ -0,0 +1,386 @@
+package pubsub
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// STOMPTransport talks STOMP 1.2 to RabbitMQ's rabbitmq_stomp plugin (port
+// 61613 by default). Exchanges and routing keys map to /exchange/<exchange>/<key>
+// destinations, and every subscription uses client-individual acks so Acktype
+// maps directly onto ACK and NACK frames.
+type STOMPTransport struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu       sync.Mutex
+	nextID   int
+	subs     map[string]*mailbox[stompFrame]
+	receipts map[string]chan error
+	err      error
+}
+
+type stompFrame struct {
+	command string
+	headers map[string]string
+	body    []byte
+}
+
+var ErrSTOMPClosed = errors.New("stomp transport closed")
+
+func DialSTOMP(addr, login, passcode, vhost string) (*STOMPTransport, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := NewSTOMPTransport(conn, login, passcode, vhost)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// NewSTOMPTransport performs the STOMP handshake on an already established
+// connection.
+func NewSTOMPTransport(conn net.Conn, login, passcode, vhost string) (*STOMPTransport, error) {
+	t := &STOMPTransport{
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		w:        bufio.NewWriter(conn),
+		subs:     map[string]*mailbox[stompFrame]{},
+		receipts: map[string]chan error{},
+	}
+
+	err := t.writeFrame(stompFrame{
+		command: "CONNECT",
+		headers: map[string]string{
+			"accept-version": "1.2",
+			"host":           vhost,
+			"login":          login,
+			"passcode":       passcode,
+			"heart-beat":     "0,0",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	frame, err := readSTOMPFrame(t.r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CONNECTED frame: %v", err)
+	}
+	if frame.command == "ERROR" {
+		return nil, fmt.Errorf("stomp connect refused: %s", frame.headers["message"])
+	}
+	if frame.command != "CONNECTED" {
+		return nil, fmt.Errorf("unexpected %s frame during connect", frame.command)
+	}
+
+	go t.readLoop()
+
+	return t, nil
+}
+
+func STOMPDestination(exchange, key string) string {
+	if exchange == "" {
+		return "/amq/queue/" + key
+	}
+	return "/exchange/" + exchange + "/" + key
+}
+
+// Publish waits for the broker's receipt, so like a publisher confirm it
+// reports a publish the broker refused, such as one to a missing exchange.
+func (t *STOMPTransport) Publish(exchange, key string, env Envelope) error {
+	return t.request(stompFrame{
+		command: "SEND",
+		headers: map[string]string{
+			"destination":  STOMPDestination(exchange, key),
+			"content-type": env.ContentType,
+		},
+		body: env.Body,
+	})
+}
+
+func (t *STOMPTransport) Subscribe(
+	exchange,
+	queueName,
+	key string,
+	queueType simpleQueueType,
+	handler func(Envelope) Acktype,
+) error {
+	t.mu.Lock()
+	t.nextID++
+	id := strconv.Itoa(t.nextID)
+	frames := newMailbox[stompFrame]()
+	t.subs[id] = frames
+	t.mu.Unlock()
+
+	err := t.request(stompFrame{
+		command: "SUBSCRIBE",
+		headers: map[string]string{
+			"id":                     id,
+			"destination":            STOMPDestination(exchange, key),
+			"ack":                    "client-individual",
+			"prefetch-count":         "10",
+			"x-queue-name":           queueName,
+			"durable":                strconv.FormatBool(queueType == Durable),
+			"auto-delete":            strconv.FormatBool(queueType == Transient),
+			"exclusive":              strconv.FormatBool(queueType == Transient),
+			"x-dead-letter-exchange": deadLetterExchange,
+		},
+	})
+	if err != nil {
+		t.mu.Lock()
+		delete(t.subs, id)
+		t.mu.Unlock()
+		return fmt.Errorf("could not subscribe to %s: %v", queueName, err)
+	}
+	fmt.Printf("Queue %v declared and bound!\n", queueName)
+
+	prefix := STOMPDestination(exchange, "")
+	// Handlers run off the read loop, so they may publish, subscribe or wait
+	// for receipts themselves.
+	go func() {
+		for {
+			frame, ok := frames.get()
+			if !ok {
+				return
+			}
+			ackt := handler(Envelope{
+				RoutingKey:  strings.TrimPrefix(frame.headers["destination"], prefix),
+				ContentType: frame.headers["content-type"],
+				Body:        frame.body,
+			})
+
+			reply := stompFrame{
+				command: "ACK",
+				headers: map[string]string{"id": frame.headers["ack"]},
+			}
+			switch ackt {
+			case NackRequeue:
+				reply.command = "NACK"
+			case NackDiscard:
+				reply.command = "NACK"
+				reply.headers["requeue"] = "false"
+			}
+			if err := t.writeFrame(reply); err != nil {
+				fmt.Printf("Error acknowledging message: %v\n", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (t *STOMPTransport) Close() error {
+	err := t.request(stompFrame{command: "DISCONNECT"})
+	closeErr := t.conn.Close()
+	if err != nil && !errors.Is(err, ErrSTOMPClosed) {
+		return err
+	}
+	return closeErr
+}
+
+// request sends a frame asking for a RECEIPT and waits for the broker to
+// process it.
+func (t *STOMPTransport) request(frame stompFrame) error {
+	t.mu.Lock()
+	if t.err != nil {
+		t.mu.Unlock()
+		return t.err
+	}
+	t.nextID++
+	receipt := "r-" + strconv.Itoa(t.nextID)
+	done := make(chan error, 1)
+	t.receipts[receipt] = done
+	t.mu.Unlock()
+
+	if frame.headers == nil {
+		frame.headers = map[string]string{}
+	}
+	frame.headers["receipt"] = receipt
+	if err := t.writeFrame(frame); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.mu.Lock()
+		delete(t.receipts, receipt)
+		t.mu.Unlock()
+		return fmt.Errorf("no receipt for %s frame", frame.command)
+	}
+}
+
+func (t *STOMPTransport) readLoop() {
+	var err error
+	for {
+		var frame stompFrame
+		frame, err = readSTOMPFrame(t.r)
+		if err != nil {
+			break
+		}
+
+		switch frame.command {
+		case "MESSAGE":
+			t.mu.Lock()
+			frames, ok := t.subs[frame.headers["subscription"]]
+			t.mu.Unlock()
+			if ok {
+				frames.put(frame)
+			}
+		case "RECEIPT":
+			t.mu.Lock()
+			done, ok := t.receipts[frame.headers["receipt-id"]]
+			delete(t.receipts, frame.headers["receipt-id"])
+			t.mu.Unlock()
+			if ok {
+				done <- nil
+			}
+		case "ERROR":
+			err = fmt.Errorf("stomp error: %s", frame.headers["message"])
+			t.mu.Lock()
+			done, ok := t.receipts[frame.headers["receipt-id"]]
+			delete(t.receipts, frame.headers["receipt-id"])
+			t.mu.Unlock()
+			if ok {
+				done <- err
+			}
+		}
+		if frame.command == "ERROR" {
+			break
+		}
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		err = ErrSTOMPClosed
+	}
+
+	t.mu.Lock()
+	t.err = err
+	for id, frames := range t.subs {
+		frames.close()
+		delete(t.subs, id)
+	}
+	for id, done := range t.receipts {
+		done <- err
+		delete(t.receipts, id)
+	}
+	t.mu.Unlock()
+	t.conn.Close()
+}
+
+func (t *STOMPTransport) writeFrame(frame stompFrame) error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	// CONNECT headers are sent verbatim, every other frame escapes them.
+	escape := frame.command != "CONNECT"
+
+	t.w.WriteString(frame.command)
+	t.w.WriteByte('\n')
+	for k, v := range frame.headers {
+		if escape {
+			k, v = escapeSTOMPHeader(k), escapeSTOMPHeader(v)
+		}
+		t.w.WriteString(k)
+		t.w.WriteByte(':')
+		t.w.WriteString(v)
+		t.w.WriteByte('\n')
+	}
+	if frame.body != nil {
+		fmt.Fprintf(t.w, "content-length:%d\n", len(frame.body))
+	}
+	t.w.WriteByte('\n')
+	t.w.Write(frame.body)
+	t.w.WriteByte(0)
+
+	return t.w.Flush()
+}
+
+func readSTOMPFrame(r *bufio.Reader) (stompFrame, error) {
+	frame := stompFrame{headers: map[string]string{}}
+
+	// Skip heart-beat EOLs between frames.
+	for frame.command == "" {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return frame, err
+		}
+		frame.command = strings.TrimRight(line, "\r\n")
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return frame, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return frame, fmt.Errorf("malformed stomp header %q", line)
+		}
+		k, v = unescapeSTOMPHeader(k), unescapeSTOMPHeader(v)
+		// Repeated headers: only the first one counts.
+		if _, seen := frame.headers[k]; !seen {
+			frame.headers[k] = v
+		}
+	}
+
+	if cl, ok := frame.headers["content-length"]; ok {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 {
+			return frame, fmt.Errorf("invalid content-length %q", cl)
+		}
+		frame.body = make([]byte, n+1)
+		if _, err := io.ReadFull(r, frame.body); err != nil {
+			return frame, err
+		}
+		if frame.body[n] != 0 {
+			return frame, errors.New("stomp frame not terminated by NUL")
+		}
+		frame.body = frame.body[:n]
+		return frame, nil
+	}
+
+	body, err := r.ReadBytes(0)
+	if err != nil {
+		return frame, err
+	}
+	frame.body = body[:len(body)-1]
+	return frame, nil
+}
+
+var (
+	stompEscaper   = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+	stompUnescaper = strings.NewReplacer("\\\\", "\\", "\\r", "\r", "\\n", "\n", "\\c", ":")
+)
+
+func escapeSTOMPHeader(s string) string {
+	return stompEscaper.Replace(s)
+}
+
+func unescapeSTOMPHeader(s string) string {
+	if !strings.ContainsRune(s, '\\') {
+		return s
+	}
+	return stompUnescaper.Replace(s)
+}
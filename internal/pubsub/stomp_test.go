@@ -0,0 +1,232 @@
+package pubsub
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// stompServer is an in-process STOMP frame server for one connection. It
+// accepts the CONNECT, answers every receipt and hands the tests every other
+// frame it reads. A frame sent to stompRefused is answered with an ERROR.
+type stompServer struct {
+	out    *STOMPTransport
+	frames chan stompFrame
+}
+
+const stompRefused = "/exchange/missing/key"
+
+func startSTOMPServer(t *testing.T) (*STOMPTransport, *stompServer) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	server := &stompServer{frames: make(chan stompFrame, 100)}
+	ready := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(ready)
+			return
+		}
+		defer conn.Close()
+
+		// Only writeFrame is used, to write the server's frames.
+		server.out = &STOMPTransport{w: bufio.NewWriter(conn)}
+		close(ready)
+
+		r := bufio.NewReader(conn)
+		for {
+			frame, err := readSTOMPFrame(r)
+			if err != nil {
+				return
+			}
+			if frame.command == "CONNECT" {
+				server.send(stompFrame{command: "CONNECTED", headers: map[string]string{"version": "1.2"}})
+				continue
+			}
+			if frame.headers["destination"] == stompRefused {
+				server.send(stompFrame{
+					command: "ERROR",
+					headers: map[string]string{"receipt-id": frame.headers["receipt"], "message": "not_found"},
+				})
+				return
+			}
+			if receipt, ok := frame.headers["receipt"]; ok {
+				server.send(stompFrame{command: "RECEIPT", headers: map[string]string{"receipt-id": receipt}})
+			}
+			if frame.command == "DISCONNECT" {
+				return
+			}
+			server.frames <- frame
+		}
+	}()
+
+	client, err := DialSTOMP(l.Addr().String(), "guest", "guest", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ready
+	t.Cleanup(func() { client.Close() })
+	return client, server
+}
+
+func (s *stompServer) send(frame stompFrame) {
+	s.out.writeFrame(frame)
+}
+
+// next returns the next frame the client sent with command, skipping others.
+func (s *stompServer) next(t *testing.T, command string) stompFrame {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case frame := <-s.frames:
+			if frame.command == command {
+				return frame
+			}
+		case <-timeout:
+			t.Fatalf("no %s frame from the client", command)
+		}
+	}
+}
+
+func TestSTOMPTransportAcks(t *testing.T) {
+	tests := []struct {
+		name    string
+		ackt    Acktype
+		command string
+		requeue string
+	}{
+		{"ack", Ack, "ACK", ""},
+		{"nack requeue", NackRequeue, "NACK", ""},
+		{"nack discard", NackDiscard, "NACK", "false"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := startSTOMPServer(t)
+
+			got := make(chan Envelope, 1)
+			err := client.Subscribe("peril_topic", "army_moves.test", "army_moves.*", Transient, func(env Envelope) Acktype {
+				got <- env
+				return tt.ackt
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sub := server.next(t, "SUBSCRIBE")
+			if sub.headers["destination"] != "/exchange/peril_topic/army_moves.*" || sub.headers["ack"] != "client-individual" {
+				t.Fatalf("unexpected SUBSCRIBE headers %v", sub.headers)
+			}
+
+			server.send(stompFrame{
+				command: "MESSAGE",
+				headers: map[string]string{
+					"subscription": sub.headers["id"],
+					"destination":  "/exchange/peril_topic/army_moves.a:b",
+					"ack":          "m-1",
+					"content-type": "application/json",
+				},
+				body: []byte(`{}`),
+			})
+
+			env := <-got
+			if env.RoutingKey != "army_moves.a:b" || env.ContentType != "application/json" || string(env.Body) != "{}" {
+				t.Errorf("handler got %+v", env)
+			}
+
+			reply := server.next(t, tt.command)
+			if reply.headers["id"] != "m-1" {
+				t.Errorf("%s for %q, want m-1", tt.command, reply.headers["id"])
+			}
+			if reply.headers["requeue"] != tt.requeue {
+				t.Errorf("requeue header %q, want %q", reply.headers["requeue"], tt.requeue)
+			}
+		})
+	}
+}
+
+func TestSTOMPPublishWaitsForReceipt(t *testing.T) {
+	client, server := startSTOMPServer(t)
+
+	err := client.Publish("peril_topic", "battles.test", Envelope{ContentType: "application/json", Body: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := server.next(t, "SEND")
+	if send.headers["receipt"] == "" {
+		t.Errorf("SEND without a receipt header: %v", send.headers)
+	}
+
+	err = client.Publish("missing", "key", Envelope{Body: []byte(`{}`)})
+	if err == nil {
+		t.Error("publish the broker refused returned no error")
+	}
+}
+
+// A handler publishing, and so waiting for a receipt, needs the read loop to keep reading while
+// more messages than any buffer holds are waiting for the handler.
+func TestSTOMPHandlerMayWaitForReceipts(t *testing.T) {
+	client, server := startSTOMPServer(t)
+
+	err := client.Subscribe("peril_topic", "army_moves.test", "army_moves.*", Transient, func(env Envelope) Acktype {
+		err := client.Publish("peril_topic", "battles.test", env)
+		if err != nil {
+			t.Error(err)
+			return NackDiscard
+		}
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := server.next(t, "SUBSCRIBE")
+
+	const n = 50
+	for i := range n {
+		server.send(stompFrame{
+			command: "MESSAGE",
+			headers: map[string]string{
+				"subscription": sub.headers["id"],
+				"destination":  "/exchange/peril_topic/army_moves.test",
+				"ack":          "m-" + strconv.Itoa(i),
+			},
+			body: []byte{byte(i)},
+		})
+	}
+
+	for range n {
+		server.next(t, "ACK")
+	}
+}
+
+func TestSTOMPHeaderEscaping(t *testing.T) {
+	tests := []struct {
+		raw     string
+		escaped string
+	}{
+		{"plain", "plain"},
+		{"army_moves.a:b", `army_moves.a\cb`},
+		{"line\nbreak", `line\nbreak`},
+		{"carriage\rreturn", `carriage\rreturn`},
+		{`back\slash`, `back\\slash`},
+		{`\c`, `\\c`},
+	}
+
+	for _, tt := range tests {
+		if got := escapeSTOMPHeader(tt.raw); got != tt.escaped {
+			t.Errorf("escapeSTOMPHeader(%q) = %q, want %q", tt.raw, got, tt.escaped)
+		}
+		if got := unescapeSTOMPHeader(tt.escaped); got != tt.raw {
+			t.Errorf("unescapeSTOMPHeader(%q) = %q, want %q", tt.escaped, got, tt.raw)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// StreamOffset selects where a stream consumer starts reading.
+type StreamOffset struct {
+	value any
+}
+
+var (
+	OffsetFirst = StreamOffset{"first"}
+	OffsetLast  = StreamOffset{"last"}
+	OffsetNext  = StreamOffset{"next"}
+)
+
+func OffsetAt(offset int64) StreamOffset {
+	return StreamOffset{offset}
+}
+
+func OffsetSince(t time.Time) StreamOffset {
+	return StreamOffset{t}
+}
+
+func (o StreamOffset) String() string {
+	return fmt.Sprint(o.value)
+}
+
+func ParseStreamOffset(s string) (StreamOffset, error) {
+	switch s {
+	case "first":
+		return OffsetFirst, nil
+	case "last":
+		return OffsetLast, nil
+	case "next":
+		return OffsetNext, nil
+	}
+
+	if offset, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return OffsetAt(offset), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return StreamOffset{}, fmt.Errorf("invalid stream offset %q: use first, last, next, a number or an RFC3339 time", s)
+	}
+	return OffsetSince(t), nil
+}
+
+// DeclareStream declares a durable stream queue and binds it to exchange with
+// key. Unlike a classic queue, consuming a stream does not remove messages, so
+// any number of consumers can read its full history.
+func DeclareStream(ch *amqp.Channel, name, exchange, key string) (amqp.Queue, error) {
+	var queue amqp.Queue
+	err := guard(func() error {
+		var err error
+		queue, err = declareStream(ch, name, exchange, key)
+		return err
+	})
+	return queue, err
+}
+
+func declareStream(ch *amqp.Channel, name, exchange, key string) (amqp.Queue, error) {
+	queue, err := ch.QueueDeclare(
+		name,
+		true,
+		false,
+		false,
+		false,
+		amqp.Table{"x-queue-type": "stream"},
+	)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	err = ch.QueueBind(name, key, exchange, false, nil)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	return queue, nil
+}
+
+func consumeStream(ch *amqp.Channel, stream string, offset StreamOffset) (<-chan amqp.Delivery, error) {
+	// Streams refuse consumers without a prefetch limit.
+	err := ch.Qos(100, 0, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return ch.Consume(stream, "", false, false, false, false, amqp.Table{
+		"x-stream-offset": offset.value,
+	})
+}
+
+// streamEndHeader marks the message a replay stops at. Only the stream
+// receives it, through the default exchange, and replays skip it.
+const streamEndHeader = "x-peril-stream-end"
+
+// markStreamEnd appends a marker to stream and returns its ID once the broker
+// confirmed it, so the messages published before it are ahead of it.
+func markStreamEnd(ctx context.Context, ch *amqp.Channel, stream string) (string, error) {
+	err := ch.Confirm(false)
+	if err != nil {
+		return "", err
+	}
+
+	id := newID()
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, "", stream, false, false, amqp.Publishing{
+		Headers: amqp.Table{streamEndHeader: id},
+	})
+	if err != nil {
+		return "", err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !acked {
+		return "", errors.New("broker nacked the end of stream marker")
+	}
+	return id, nil
+}
+
+// ReplayStreamGob reads a stream from offset up to where it ended when the
+// replay began, calls handler for every message and returns the number of
+// messages replayed. Messages published meanwhile are left to live consumers,
+// which can tell them apart by their MessageID.
+func ReplayStreamGob[T any](
+	ctx context.Context,
+	conn *amqp.Connection,
+	stream string,
+	offset StreamOffset,
+	handler func(Message[T]) error,
+) (int, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	end, err := markStreamEnd(ctx, ch, stream)
+	if err != nil {
+		return 0, fmt.Errorf("could not mark the end of stream %s: %v", stream, err)
+	}
+
+	deliveryCh, err := consumeStream(ch, stream, offset)
+	if err != nil {
+		return 0, fmt.Errorf("could not consume stream %s: %v", stream, err)
+	}
+
+	count := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return count, ctx.Err()
+		case message, ok := <-deliveryCh:
+			if !ok {
+				return count, fmt.Errorf("stream %s closed during replay", stream)
+			}
+
+			// Earlier replays left markers of their own.
+			if mark, ok := message.Headers[streamEndHeader]; ok {
+				message.Ack(false)
+				if mark == end {
+					return count, nil
+				}
+				continue
+			}
+
+			var val T
+			if err := gob.NewDecoder(bytes.NewReader(message.Body)).Decode(&val); err != nil {
+				return count, fmt.Errorf("could not decode message at offset %v: %v", message.Headers["x-stream-offset"], err)
+			}
+			err := handler(Message[T]{
+				Body:          val,
+				Queue:         stream,
+				RoutingKey:    message.RoutingKey,
+				MessageID:     message.MessageId,
+				Headers:       message.Headers,
+				CorrelationID: message.CorrelationId,
+				Timestamp:     message.Timestamp,
+			})
+			if err != nil {
+				return count, err
+			}
+			message.Ack(false)
+			count++
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseStreamOffset(t *testing.T) {
+	since := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		input   string
+		want    StreamOffset
+		wantErr bool
+	}{
+		{input: "first", want: OffsetFirst},
+		{input: "last", want: OffsetLast},
+		{input: "next", want: OffsetNext},
+		{input: "42", want: OffsetAt(42)},
+		{input: "2024-05-01T12:00:00Z", want: OffsetSince(since)},
+		{input: "", wantErr: true},
+		{input: "yesterday", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseStreamOffset(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseStreamOffset(%q) = %v, want an error", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseStreamOffset(%q): %v", tt.input, err)
+			}
+			if got.String() != tt.want.String() {
+				t.Errorf("ParseStreamOffset(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// A Tenant is one independent Peril world sharing a broker with others. It is
+// isolated either by its own vhost, or by prefixing the names of its exchanges
+// and queues within a shared vhost, dead letters included.
+type Tenant struct {
+	// Name is empty for the default, unscoped world.
+	Name string
+	Mode TenantMode
+}
+
+type TenantMode int
+
+const (
+	// TenantPrefix prefixes exchange and queue names with the tenant name.
+	TenantPrefix TenantMode = iota
+	// TenantVHost connects to the vhost named after the tenant and leaves
+	// names alone.
+	TenantVHost
+)
+
+// ParseTenant parses a tenant as set in PERIL_TENANT: "" for the default
+// world, "<name>" for a prefixed tenant or "vhost:<name>" for a tenant with
+// its own vhost.
+func ParseTenant(s string) (Tenant, error) {
+	if s == "" {
+		return Tenant{}, nil
+	}
+
+	t := Tenant{Name: s, Mode: TenantPrefix}
+	if name, ok := strings.CutPrefix(s, "vhost:"); ok {
+		t = Tenant{Name: name, Mode: TenantVHost}
+	}
+
+	if t.Name == "" {
+		return Tenant{}, fmt.Errorf("invalid tenant %q: empty name", s)
+	}
+	for _, r := range t.Name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return Tenant{}, fmt.Errorf("invalid tenant %q: names may only contain letters, digits, '-' and '_'", s)
+		}
+	}
+	return t, nil
+}
+
+func (t Tenant) String() string {
+	switch {
+	case t.Name == "":
+		return "default"
+	case t.Mode == TenantVHost:
+		return "vhost:" + t.Name
+	}
+	return t.Name
+}
+
+// Prefixed reports whether the tenant's exchange and queue names differ from
+// the default world's.
+func (t Tenant) Prefixed() bool {
+	return t.Name != "" && t.Mode == TenantPrefix
+}
+
+// Exchange returns the tenant's name for exchange. The default exchange and
+// the broker's amq.* exchanges are shared and never prefixed.
+func (t Tenant) Exchange(name string) string {
+	if !t.Prefixed() || name == "" || strings.HasPrefix(name, "amq.") {
+		return name
+	}
+	return t.Name + "." + name
+}
+
+// Queue returns the tenant's name for queue. Empty names, which ask the
+// broker to generate one, are left alone.
+func (t Tenant) Queue(name string) string {
+	if !t.Prefixed() || name == "" {
+		return name
+	}
+	return t.Name + "." + name
+}
+
+// URL points base at the tenant's vhost, if it has one.
+func (t Tenant) URL(base string) (string, error) {
+	if t.Name == "" || t.Mode != TenantVHost {
+		return base, nil
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		// url.Parse errors quote the url, password included.
+		return "", errors.New("could not parse broker url")
+	}
+	u.Path = "/" + t.Name
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+func (t Tenant) Dial(base string, opts DialOptions) (*amqp.Connection, error) {
+	u, err := t.URL(base)
+	if err != nil {
+		return nil, err
+	}
+	return Dial(u, opts)
+}
+
+// deadLetterExchange is where discarded messages go, the tenant's own
+// DeadLetterExchange once UseTenant ran.
+var deadLetterExchange = DeadLetterExchange
+
+// UseTenant dead-letters to the tenant's DeadLetterExchange. Call it once at
+// startup, before anything is subscribed.
+func UseTenant(t Tenant) {
+	deadLetterExchange = t.Exchange(DeadLetterExchange)
+}
+
+// ScopeTopic returns topic published to the tenant's exchange.
+func ScopeTopic[T any](t Tenant, topic Topic[T]) Topic[T] {
+	topic.Exchange = t.Exchange(topic.Exchange)
+	return topic
+}
+
+// DeclareExchange declares a durable exchange. A tenant's exchanges don't
+// exist until something declares them.
+func DeclareExchange(ch *amqp.Channel, name, kind string) error {
+	return guard(func() error {
+		err := ch.ExchangeDeclare(name, kind, true, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not declare %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// DeclareDeadLetters declares the tenant's fanout DeadLetterExchange and the
+// durable queue that collects everything dead-lettered to it.
+func DeclareDeadLetters(ch *amqp.Channel, queue string) error {
+	err := DeclareExchange(ch, deadLetterExchange, amqp.ExchangeFanout)
+	if err != nil {
+		return err
+	}
+	return guard(func() error {
+		_, err := ch.QueueDeclare(queue, true, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not declare %s: %w", queue, err)
+		}
+		err = ch.QueueBind(queue, "", deadLetterExchange, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not bind %s to %s: %w", queue, deadLetterExchange, err)
+		}
+		return nil
+	})
+}
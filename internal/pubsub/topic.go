@@ -0,0 +1,144 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Codec encodes message bodies and names the content type it produces.
+type Codec interface {
+	ContentType() string
+	Encode(v any) ([]byte, error)
+	Decode(data []byte, v any) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Encode(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Decode(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return "application/gob" }
+
+func (gobCodec) Encode(v any) ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Decode(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+var (
+	JSON Codec = jsonCodec{}
+	Gob  Codec = gobCodec{}
+)
+
+// CodecFor returns the codec producing contentType.
+func CodecFor(contentType string) (Codec, error) {
+	switch contentType {
+	case JSON.ContentType():
+		return JSON, nil
+	case Gob.ContentType():
+		return Gob, nil
+	}
+	return nil, fmt.Errorf("no codec for content type %q", contentType)
+}
+
+// decode decodes body with codec, refusing messages whose content type says
+// they were encoded with something else. Messages without a content type (for
+// example from MQTT clients) are decoded as is.
+func decode(codec Codec, contentType string, body []byte, v any) error {
+	if contentType != "" && contentType != codec.ContentType() {
+		return fmt.Errorf("expected %s message, got %s", codec.ContentType(), contentType)
+	}
+	return codec.Decode(body, v)
+}
+
+// Topic ties together where a kind of message is published, the Go type it
+// carries and how that type is encoded, so publishers and subscribers of the
+// same topic can't disagree.
+type Topic[T any] struct {
+	Name     string
+	Exchange string
+	// Pattern is the binding key subscribers use.
+	Pattern string
+	// Key returns the routing key a value is published with.
+	Key   func(T) string
+	Codec Codec
+	// Headers optionally returns message headers, for subscribers filtering
+	// on a headers exchange.
+	Headers func(T) map[string]any
+}
+
+func (t Topic[T]) headers(val T) amqp.Table {
+	if t.Headers == nil {
+		return nil
+	}
+	return amqp.Table(t.Headers(val))
+}
+
+func Publish[T any](ch *amqp.Channel, topic Topic[T], val T) error {
+	err := publish(ch, topic.Exchange, topic.Key(val), topic.Codec, topic.headers(val), val)
+	if err != nil {
+		return fmt.Errorf("could not publish to %s: %w", topic.Name, err)
+	}
+	return nil
+}
+
+func Subscribe[T any](
+	conn *amqp.Connection,
+	topic Topic[T],
+	queueName string,
+	queueType simpleQueueType,
+	handler func(T) Acktype,
+) error {
+	return subscribe(conn, topic.Exchange, queueName, topic.Pattern, queueType, topic.Codec, handler)
+}
+
+func PublishVia[T any](t Transport, topic Topic[T], val T) error {
+	encoded, err := topic.Codec.Encode(val)
+	if err != nil {
+		return err
+	}
+
+	key := topic.Key(val)
+	err = t.Publish(topic.Exchange, key, Envelope{
+		RoutingKey:  key,
+		ContentType: topic.Codec.ContentType(),
+		Body:        encoded,
+	})
+	if err != nil {
+		return fmt.Errorf("could not publish to %s: %v", topic.Name, err)
+	}
+	return nil
+}
+
+func SubscribeVia[T any](
+	t Transport,
+	topic Topic[T],
+	queueName string,
+	queueType simpleQueueType,
+	handler func(T) Acktype,
+) error {
+	return t.Subscribe(topic.Exchange, queueName, topic.Pattern, queueType, func(env Envelope) Acktype {
+		var val T
+		if err := decode(topic.Codec, env.ContentType, env.Body, &val); err != nil {
+			fmt.Printf("Error decoding %s message: %v\n", topic.Name, err)
+			return NackDiscard
+		}
+		return handler(val)
+	})
+}
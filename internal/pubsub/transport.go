@@ -0,0 +1,160 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Transport is the protocol independent part of the broker API: publishing to
+// an exchange with a routing key and consuming from a queue bound with a key.
+// AMQPTransport, STOMPTransport and MQTTTransport implement it.
+type Transport interface {
+	Publish(exchange, key string, env Envelope) error
+	Subscribe(exchange, queueName, key string, queueType simpleQueueType, handler func(Envelope) Acktype) error
+	Close() error
+}
+
+// Envelope is an encoded message as it travels through a Transport.
+type Envelope struct {
+	RoutingKey  string
+	ContentType string
+	Body        []byte
+}
+
+type AMQPTransport struct {
+	conn *amqp.Connection
+	ch   *amqp.Channel
+	mu   sync.Mutex
+}
+
+func NewAMQPTransport(conn *amqp.Connection) (*AMQPTransport, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	return &AMQPTransport{
+		conn: conn,
+		ch:   ch,
+	}, nil
+}
+
+func (t *AMQPTransport) Publish(exchange, key string, env Envelope) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return guard(func() error {
+		return t.ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
+			ContentType: env.ContentType,
+			Body:        env.Body,
+		})
+	})
+}
+
+func (t *AMQPTransport) Subscribe(
+	exchange,
+	queueName,
+	key string,
+	queueType simpleQueueType,
+	handler func(Envelope) Acktype,
+) error {
+	ch, _, err := DeclareAndBind(t.conn, exchange, queueName, key, queueType)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to %s: %v", queueName, err)
+	}
+
+	deliveryCh, err := ch.Consume(queueName, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for delivery := range deliveryCh {
+			ackt := handler(Envelope{
+				RoutingKey:  delivery.RoutingKey,
+				ContentType: delivery.ContentType,
+				Body:        delivery.Body,
+			})
+			switch ackt {
+			case Ack:
+				delivery.Ack(false)
+			case NackRequeue:
+				delivery.Nack(false, true)
+			case NackDiscard:
+				delivery.Nack(false, false)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close closes the transport's publishing channel. The connection stays open
+// since it is owned by the caller.
+func (t *AMQPTransport) Close() error {
+	return t.ch.Close()
+}
+
+// mailbox queues a subscription's deliveries for its handler goroutine. put
+// never blocks, so a transport's read loop keeps reading frames, receipts
+// and acknowledgements while a handler waits on one of them.
+type mailbox[T any] struct {
+	mu     sync.Mutex
+	queue  []T
+	closed bool
+	ready  chan struct{}
+}
+
+func newMailbox[T any]() *mailbox[T] {
+	return &mailbox[T]{ready: make(chan struct{}, 1)}
+}
+
+func (m *mailbox[T]) put(v T) {
+	m.mu.Lock()
+	if !m.closed {
+		m.queue = append(m.queue, v)
+	}
+	m.mu.Unlock()
+	m.wake()
+}
+
+// close lets get return false once the queued deliveries are taken.
+func (m *mailbox[T]) close() {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+	m.wake()
+}
+
+func (m *mailbox[T]) wake() {
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+// get waits for the next delivery. It returns false when the mailbox is
+// closed and empty.
+func (m *mailbox[T]) get() (T, bool) {
+	for {
+		m.mu.Lock()
+		if len(m.queue) > 0 {
+			v := m.queue[0]
+			var zero T
+			m.queue[0] = zero
+			m.queue = m.queue[1:]
+			m.mu.Unlock()
+			return v, true
+		}
+		closed := m.closed
+		m.mu.Unlock()
+		if closed {
+			var zero T
+			return zero, false
+		}
+		<-m.ready
+	}
+}
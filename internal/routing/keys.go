@@ -0,0 +1,211 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// Usernames end up as a single word of topic routing keys, so the characters
+// AMQP gives a meaning to ('.', '*' and '#') are percent-escaped, together
+// with '%' itself.
+var usernameEscaper = strings.NewReplacer(
+	"%", "%25",
+	".", "%2E",
+	"*", "%2A",
+	"#", "%23",
+)
+
+const maxUsernameLength = 64
+
+func ValidateUsername(username string) error {
+	if username == "" {
+		return errors.New("username must not be empty")
+	}
+	if len(username) > maxUsernameLength {
+		return fmt.Errorf("username must be at most %d bytes long", maxUsernameLength)
+	}
+	for _, r := range username {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("username %q must not contain whitespace or control characters", username)
+		}
+	}
+	return nil
+}
+
+func EscapeUsername(username string) string {
+	return usernameEscaper.Replace(username)
+}
+
+func UnescapeUsername(word string) (string, error) {
+	username, err := url.PathUnescape(word)
+	if err != nil {
+		return "", fmt.Errorf("invalid escaped username %q: %v", word, err)
+	}
+	return username, nil
+}
+
+func userKey(prefix, username string) string {
+	return prefix + "." + EscapeUsername(username)
+}
+
+func parseUserKey(prefix, key string) (string, error) {
+	word, ok := strings.CutPrefix(key, prefix+".")
+	if !ok || word == "" || strings.Contains(word, ".") {
+		return "", fmt.Errorf("%q is not a %s key", key, prefix)
+	}
+	return UnescapeUsername(word)
+}
+
+func ArmyMovesKey(username string) string {
+	return userKey(ArmyMovesPrefix, username)
+}
+
+func ArmyMovesPattern() string {
+	return ArmyMovesPrefix + ".*"
+}
+
+func ParseArmyMovesKey(key string) (username string, err error) {
+	return parseUserKey(ArmyMovesPrefix, key)
+}
+
+// ArmyMovesQueue is the player's own queue of the army moves touching the
+// locations they occupy.
+func ArmyMovesQueue(username string) string {
+	return userKey(ArmyMovesPrefix, username)
+}
+
+// BattleKey routes the outcome of a battle by its location, escaped like a
+// username.
+func BattleKey(location string) string {
+	return userKey(BattlesPrefix, location)
+}
+
+func BattlePattern() string {
+	return BattlesPrefix + ".*"
+}
+
+// BattleQueue is the player's own queue of battle outcomes.
+func BattleQueue(username string) string {
+	return userKey(BattlesPrefix, username)
+}
+
+func GameLogKey(username string) string {
+	return userKey(GameLogSlug, username)
+}
+
+func GameLogPattern() string {
+	return GameLogSlug + ".*"
+}
+
+func ParseGameLogKey(key string) (username string, err error) {
+	return parseUserKey(GameLogSlug, key)
+}
+
+// GameLogQueue is the durable queue the server writes game.log from.
+func GameLogQueue() string {
+	return GameLogSlug
+}
+
+// GameLogGatewayQueue is the gateway's per-player copy of the game logs.
+func GameLogGatewayQueue(username string) string {
+	return GameLogSlug + ".gateway." + EscapeUsername(username)
+}
+
+// RulesetGatewayQueue is one peril-gateway's queue for the ruleset, told
+// apart from other gateways by id.
+func RulesetGatewayQueue(id string) string {
+	return RulesetKey + ".gateway." + id
+}
+
+// WatchQueue is one peril-watch's transient queue of the messages with
+// prefix, told apart from other watchers by id.
+func WatchQueue(prefix, id string) string {
+	return prefix + ".watch." + id
+}
+
+func SpawnKey(username string) string {
+	return userKey(SpawnsPrefix, username)
+}
+
+func SpawnPattern() string {
+	return SpawnsPrefix + ".*"
+}
+
+func ParseSpawnKey(key string) (username string, err error) {
+	return parseUserKey(SpawnsPrefix, key)
+}
+
+func MoveVerdictKey(username string) string {
+	return userKey(MoveVerdictsPrefix, username)
+}
+
+func MoveVerdictPattern() string {
+	return MoveVerdictsPrefix + ".*"
+}
+
+// MoveVerdictQueue is the player's own queue of the server's verdicts on
+// their moves.
+func MoveVerdictQueue(username string) string {
+	return userKey(MoveVerdictsPrefix, username)
+}
+
+func SyncKey(username string) string {
+	return userKey(SyncsPrefix, username)
+}
+
+func SyncPattern() string {
+	return SyncsPrefix + ".*"
+}
+
+func ParseSyncKey(key string) (username string, err error) {
+	return parseUserKey(SyncsPrefix, key)
+}
+
+// LedgerQueue is the server's durable queue of the messages with prefix that
+// feed its ledger, such as LedgerQueue(SpawnsPrefix).
+func LedgerQueue(prefix string) string {
+	return LedgerSlug + "." + prefix
+}
+
+// PauseQueue is the player's own queue for pause state on peril_direct.
+func PauseQueue(username string) string {
+	return userKey(PauseKey, username)
+}
+
+// RulesetQueue is the player's own queue for the ruleset on peril_direct.
+func RulesetQueue(username string) string {
+	return userKey(RulesetKey, username)
+}
+
+// MatchTopic reports whether key matches the AMQP topic binding pattern,
+// where '*' matches exactly one word and '#' matches zero or more words.
+func MatchTopic(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "#":
+			for i := 0; i <= len(key); i++ {
+				if matchWords(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(key) == 0 {
+				return false
+			}
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
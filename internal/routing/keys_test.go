@@ -0,0 +1,121 @@
+package routing
+
+import "testing"
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		wantErr  bool
+	}{
+		{"alice", false},
+		// Characters with a meaning in routing keys are escaped, not refused.
+		{"bob.*#", false},
+		{"100%", false},
+		{"", true},
+		{"two words", true},
+		{"tab\there", true},
+		{string(make([]byte, maxUsernameLength+1)), true},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateUsername(tt.username); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateUsername(%q) = %v, want error %v", tt.username, err, tt.wantErr)
+		}
+	}
+}
+
+func TestEscapeUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		escaped  string
+	}{
+		{"alice", "alice"},
+		{"a.b", "a%2Eb"},
+		{"*", "%2A"},
+		{"#", "%23"},
+		{"100%", "100%25"},
+		{"%2E", "%252E"},
+		{"ünïcode", "ünïcode"},
+	}
+
+	for _, tt := range tests {
+		escaped := EscapeUsername(tt.username)
+		if escaped != tt.escaped {
+			t.Errorf("EscapeUsername(%q) = %q, want %q", tt.username, escaped, tt.escaped)
+		}
+		username, err := UnescapeUsername(escaped)
+		if err != nil || username != tt.username {
+			t.Errorf("UnescapeUsername(%q) = %q, %v, want %q", escaped, username, err, tt.username)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      string
+		parse    func(string) (string, error)
+		username string
+		wantErr  bool
+	}{
+		{"army moves", ArmyMovesKey("alice"), ParseArmyMovesKey, "alice", false},
+		{"army moves escaped", ArmyMovesKey("a.*#%"), ParseArmyMovesKey, "a.*#%", false},
+		{"spawns", SpawnKey("a.*#%"), ParseSpawnKey, "a.*#%", false},
+		{"spawn parsed as army move", SpawnKey("alice"), ParseArmyMovesKey, "", true},
+		{"syncs", SyncKey("a.*#%"), ParseSyncKey, "a.*#%", false},
+		{"spawn parsed as sync", SpawnKey("alice"), ParseSyncKey, "", true},
+		{"game logs escaped", GameLogKey("bob.smith"), ParseGameLogKey, "bob.smith", false},
+		{"wrong prefix", GameLogKey("alice"), ParseArmyMovesKey, "", true},
+		{"no username", ArmyMovesPrefix + ".", ParseArmyMovesKey, "", true},
+		{"too many words", ArmyMovesPrefix + ".a.b", ParseArmyMovesKey, "", true},
+		{"bad escape", ArmyMovesPrefix + ".%zz", ParseArmyMovesKey, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, err := tt.parse(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsing %q: error %v, want error %v", tt.key, err, tt.wantErr)
+			}
+			if username != tt.username {
+				t.Errorf("parsing %q = %q, want %q", tt.key, username, tt.username)
+			}
+		})
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"army_moves.*", "army_moves.alice", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.alice.bob", false},
+		{"army_moves.*", "battles.alice", false},
+		{"game_logs.#", "game_logs", true},
+		{"game_logs.#", "game_logs.alice", true},
+		{"game_logs.#", "game_logs.a.b.c", true},
+		{"#", "anything.at.all", true},
+		{"#.alice", "army_moves.alice", true},
+		{"#.alice", "alice", true},
+		{"#.alice", "army_moves.bob", false},
+		{"*.*", "a.b", true},
+		{"*.*", "a", false},
+		{"a.#.z", "a.z", true},
+		{"a.#.z", "a.b.c.z", true},
+		{"a.#.z", "a.b.c", false},
+		{"pause", "pause", true},
+		{"pause", "ruleset", false},
+		// Escaped usernames stay one word.
+		{"army_moves.*", ArmyMovesKey("a.b"), true},
+		{ArmyMovesKey("*"), ArmyMovesKey("alice"), false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchTopic(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
@@ -3,14 +3,31 @@ package routing
 const (
 	ArmyMovesPrefix = "army_moves"
 
-	WarRecognitionsPrefix = "war"
+	BattlesPrefix = "battles"
+
+	SpawnsPrefix = "spawns"
+
+	MoveVerdictsPrefix = "move_verdicts"
+
+	SyncsPrefix = "syncs"
+
+	LedgerSlug = "ledger"
 
 	PauseKey = "pause"
 
+	RulesetKey = "ruleset"
+
 	GameLogSlug = "game_logs"
+
+	GameLogStream = "game_logs_stream"
+
+	DeadLetterQueue = "peril_dlq"
 )
 
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
+	// ExchangePerilHeaders receives the army moves published to
+	// ExchangePerilTopic and routes them on their location headers.
+	ExchangePerilHeaders = "peril_headers"
 )
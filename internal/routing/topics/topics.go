@@ -0,0 +1,182 @@
+// Package topics describes every message Peril sends: the exchange and key it
+// travels with, its Go type and its codec. It lives apart from gamelogic so
+// the game rules don't depend on the broker.
+package topics
+
+import (
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ArmyMoves = pubsub.Topic[gamelogic.ArmyMove]{
+	Name:     "army moves",
+	Exchange: routing.ExchangePerilTopic,
+	Pattern:  routing.ArmyMovesPattern(),
+	Key: func(mv gamelogic.ArmyMove) string {
+		return routing.ArmyMovesKey(mv.Player.Username)
+	},
+	Codec:   pubsub.JSON,
+	Headers: armyMoveHeaders,
+}
+
+// armyMoveHeaders names the moving player and every location they occupy
+// after the move, which are the locations HandleMove checks for conflicts.
+// Travelling units occupy none.
+func armyMoveHeaders(mv gamelogic.ArmyMove) map[string]any {
+	headers := map[string]any{"player": mv.Player.Username}
+	for _, unit := range mv.Player.Units {
+		if !unit.InTransit() {
+			headers[LocationHeader(unit.Location)] = true
+		}
+	}
+	return headers
+}
+
+func LocationHeader(loc gamelogic.Location) string {
+	return "location." + string(loc)
+}
+
+// OccupiedLocationsFilter matches the army moves that touch a location p has
+// units in.
+func OccupiedLocationsFilter(p gamelogic.Player) pubsub.HeaderFilter {
+	headers := map[string]any{}
+	for _, unit := range p.Units {
+		if !unit.InTransit() {
+			headers[LocationHeader(unit.Location)] = true
+		}
+	}
+	return pubsub.HeaderFilter{Match: pubsub.MatchAny, Headers: headers}
+}
+
+var Spawns = pubsub.Topic[gamelogic.ArmySpawn]{
+	Name:     "spawns",
+	Exchange: routing.ExchangePerilTopic,
+	Pattern:  routing.SpawnPattern(),
+	Key: func(sp gamelogic.ArmySpawn) string {
+		return routing.SpawnKey(sp.Username)
+	},
+	Codec: pubsub.JSON,
+}
+
+var MoveVerdicts = pubsub.Topic[gamelogic.MoveVerdict]{
+	Name:     "move verdicts",
+	Exchange: routing.ExchangePerilTopic,
+	Pattern:  routing.MoveVerdictPattern(),
+	Key: func(v gamelogic.MoveVerdict) string {
+		return routing.MoveVerdictKey(v.Player.Username)
+	},
+	Codec: pubsub.JSON,
+}
+
+// MoveVerdictsFor narrows MoveVerdicts to the verdicts on one player's
+// moves.
+func MoveVerdictsFor(username string) pubsub.Topic[gamelogic.MoveVerdict] {
+	topic := MoveVerdicts
+	topic.Pattern = routing.MoveVerdictKey(username)
+	return topic
+}
+
+// Syncs asks the server's ledger for a player's units, with
+// pubsub.Request.
+var Syncs = pubsub.Topic[gamelogic.SyncRequest]{
+	Name:     "syncs",
+	Exchange: routing.ExchangePerilTopic,
+	Pattern:  routing.SyncPattern(),
+	Key: func(r gamelogic.SyncRequest) string {
+		return routing.SyncKey(r.Username)
+	},
+	Codec: pubsub.JSON,
+}
+
+// Battles carries the server's outcome of every battle, which is the
+// only word on who survived it.
+var Battles = pubsub.Topic[gamelogic.BattleResult]{
+	Name:     "battles",
+	Exchange: routing.ExchangePerilTopic,
+	Pattern:  routing.BattlePattern(),
+	Key: func(b gamelogic.BattleResult) string {
+		return routing.BattleKey(string(b.Location))
+	},
+	Codec: pubsub.JSON,
+}
+
+var GameLogs = pubsub.Topic[routing.GameLog]{
+	Name:     "game logs",
+	Exchange: routing.ExchangePerilTopic,
+	Pattern:  routing.GameLogPattern(),
+	Key: func(gl routing.GameLog) string {
+		return routing.GameLogKey(gl.Username)
+	},
+	Codec: pubsub.Gob,
+}
+
+var Pause = pubsub.Topic[routing.PlayingState]{
+	Name:     "pause",
+	Exchange: routing.ExchangePerilDirect,
+	Pattern:  routing.PauseKey,
+	Key: func(routing.PlayingState) string {
+		return routing.PauseKey
+	},
+	Codec: pubsub.JSON,
+}
+
+// Ruleset is retained, so players joining later learn the rules too.
+var Ruleset = pubsub.Topic[gamelogic.Ruleset]{
+	Name:     "ruleset",
+	Exchange: routing.ExchangePerilDirect,
+	Pattern:  routing.RulesetKey,
+	Key: func(gamelogic.Ruleset) string {
+		return routing.RulesetKey
+	},
+	Codec: pubsub.JSON,
+}
+
+// UseExchanges moves every topic to the given exchanges. Like UseTenant, call
+// it once at startup, and before UseTenant.
+func UseExchanges(direct, topic string) {
+	ArmyMoves.Exchange = topic
+	Spawns.Exchange = topic
+	MoveVerdicts.Exchange = topic
+	Syncs.Exchange = topic
+	Battles.Exchange = topic
+	GameLogs.Exchange = topic
+	Pause.Exchange = direct
+	Ruleset.Exchange = direct
+}
+
+// deadLetterQueue collects the tenant's dead letters.
+var deadLetterQueue = routing.DeadLetterQueue
+
+// UseTenant moves every topic, and the dead letters, to the tenant's
+// exchanges and queues. Call it once at startup, before anything is published
+// or subscribed.
+func UseTenant(t pubsub.Tenant) {
+	pubsub.UseTenant(t)
+	deadLetterQueue = t.Queue(routing.DeadLetterQueue)
+	ArmyMoves = pubsub.ScopeTopic(t, ArmyMoves)
+	Spawns = pubsub.ScopeTopic(t, Spawns)
+	MoveVerdicts = pubsub.ScopeTopic(t, MoveVerdicts)
+	Syncs = pubsub.ScopeTopic(t, Syncs)
+	Battles = pubsub.ScopeTopic(t, Battles)
+	GameLogs = pubsub.ScopeTopic(t, GameLogs)
+	Pause = pubsub.ScopeTopic(t, Pause)
+	Ruleset = pubsub.ScopeTopic(t, Ruleset)
+}
+
+// DeclareExchanges declares the exchanges the topics use, and the dead
+// letter exchange and queue, whatever the tenant: a vhost tenant starts on an
+// empty vhost and a prefixed one on exchanges nobody declared. Declaring
+// exchanges that already exist with the same settings does nothing.
+func DeclareExchanges(ch *amqp.Channel) error {
+	err := pubsub.DeclareExchange(ch, Pause.Exchange, amqp.ExchangeDirect)
+	if err != nil {
+		return err
+	}
+	err = pubsub.DeclareExchange(ch, ArmyMoves.Exchange, amqp.ExchangeTopic)
+	if err != nil {
+		return err
+	}
+	return pubsub.DeclareDeadLetters(ch, deadLetterQueue)
+}
@@ -0,0 +1,59 @@
+package topics
+
+import (
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// Every topic must publish with keys its own subscribers are bound to, for
+// any username.
+func TestTopicKeysMatchPatterns(t *testing.T) {
+	for _, username := range []string{"alice", "bob.smith", "*", "#", "a.*.#", "100%"} {
+		player := gamelogic.Player{Username: username}
+		tests := []struct {
+			name    string
+			pattern string
+			key     string
+		}{
+			{"army moves", ArmyMoves.Pattern, ArmyMoves.Key(gamelogic.ArmyMove{Player: player})},
+			{"spawns", Spawns.Pattern, Spawns.Key(gamelogic.ArmySpawn{Username: username})},
+			{"move verdicts", MoveVerdicts.Pattern, MoveVerdicts.Key(gamelogic.MoveVerdict{Player: player})},
+			{"own move verdicts", MoveVerdictsFor(username).Pattern, MoveVerdicts.Key(gamelogic.MoveVerdict{Player: player})},
+			{"syncs", Syncs.Pattern, Syncs.Key(gamelogic.SyncRequest{Username: username})},
+			{"battles", Battles.Pattern, Battles.Key(gamelogic.BattleResult{Location: gamelogic.Location(username)})},
+			{"game logs", GameLogs.Pattern, GameLogs.Key(routing.GameLog{Username: username})},
+			{"pause", Pause.Pattern, Pause.Key(routing.PlayingState{})},
+			{"ruleset", Ruleset.Pattern, Ruleset.Key(gamelogic.Ruleset{})},
+		}
+
+		for _, tt := range tests {
+			if !routing.MatchTopic(tt.pattern, tt.key) {
+				t.Errorf("%s key %q for %q doesn't match pattern %q", tt.name, tt.key, username, tt.pattern)
+			}
+		}
+	}
+}
+
+// A player's own verdict queue must not receive anyone else's verdicts, even
+// when usernames contain wildcards.
+func TestMoveVerdictsForIsOwnOnly(t *testing.T) {
+	tests := []struct {
+		username string
+		other    string
+	}{
+		{"alice", "bob"},
+		{"*", "alice"},
+		{"#", "alice"},
+		{"a.b", "a"},
+	}
+
+	for _, tt := range tests {
+		pattern := MoveVerdictsFor(tt.username).Pattern
+		key := MoveVerdicts.Key(gamelogic.MoveVerdict{Player: gamelogic.Player{Username: tt.other}})
+		if routing.MatchTopic(pattern, key) {
+			t.Errorf("%s's verdicts pattern %q matches %s's key %q", tt.username, pattern, tt.other, key)
+		}
+	}
+}